@@ -6,16 +6,25 @@ https://github.com/brenns10/slacksoc/wiki
 */
 package lib
 
+import "bytes"
+import "context"
 import "encoding/gob"
+import "flag"
 import "fmt"
+import "io/ioutil"
+import "math"
 import "os"
+import "os/signal"
 import "regexp"
+import "strings"
 import "sync"
+import "syscall"
 import "time"
+import "unicode"
+import "unicode/utf8"
 
 import "github.com/nlopes/slack"
 import "github.com/sirupsen/logrus"
-import "github.com/google/shlex"
 
 /*
 Bot is the publicly exported type that contains most of the Slacksoc framework.
@@ -39,20 +48,102 @@ type Bot struct {
 	infoLock      sync.RWMutex
 	userByName    map[string]*slack.User
 	userByID      map[string]*slack.User
+	userByEmail   map[string]*slack.User
+	userByDisplay map[string][]*slack.User
+	userByReal    map[string][]*slack.User
+	channels      map[string]*channelInfo
 	channelByName map[string]string
-	channelByID   map[string]string
+	userGroups    map[string]*slack.UserGroup
+	groupByHandle map[string]string
 
-	// This stuff is for plugin state and saving.
+	// This stuff is for plugin state and saving. The state map, dirty flag and
+	// save timer are protected by stateLock, so that state may be read and
+	// updated from any goroutine. saveLock serializes writes to the state
+	// file, so that an older snapshot can never overwrite a newer one.
+	stateLock  sync.RWMutex
 	state      map[string][]byte
+	stateDirty bool
+	stateTimer *time.Timer
 	stateDelay int
 	stateFile  string
-	stateDirty bool
-	stateChan  chan pluginStateEvent
+	saveLock   sync.Mutex
+
+	// The scheduler's clock, and the jobs waiting for the bot to connect.
+	// schedLock also protects the durable timer handlers and jobs.
+	clock          Clock
+	schedLock      sync.Mutex
+	schedStarted   bool
+	schedStartTime time.Time
+	pendingJobs    []*Job
+	timerHandlers  map[string]TimerHandler
+	timerJobs      map[string]*armedTimer
+
+	// Conversations waiting for a reply, by user and channel.
+	convLock      sync.Mutex
+	conversations map[string]*Conversation
+
+	// Messages which edit handlers have seen, and the bot's replies to them
+	// (see HandleEdits). replyAcks holds replies waiting for an ack.
+	trackLock    sync.Mutex
+	tracked      map[string]*trackedMessage
+	trackOrder   []string
+	replyAcks    map[int]string
+	editHandlers int
+
+	// Messages which were reacted to (see GetMessage), oldest first.
+	msgLock  sync.Mutex
+	msgCache map[string]*slack.Msg
+	msgOrder []string
+
+	// Global middleware (see Use), and the roles from the config file.
+	middleware []Middleware
+	roles      map[string][]string
+
+	// How messages address the bot: the command prefix and nicknames from
+	// the config file, and the regex built from them once we know our name.
+	prefix        string
+	nicknames     []string
+	addressRegexp *regexp.Regexp
+
+	// What to do about unknown commands, by default and in each channel (by
+	// name or ID). See unknownCommand.
+	unknownDefault string
+	unknownModes   map[string]string
+
+	// The bot's lifetime, which ends when it shuts down, and how long
+	// commands may take. ctxLock protects closing and adding to inflight,
+	// the commands which are using a context from CommandContext().
+	ctx      context.Context
+	cancel   context.CancelFunc
+	ctxLock  sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+	timeout  time.Duration
+	timeouts map[string]time.Duration
 
 	// These private attributes should just never be accessed outside of the
-	// main bot thread. They have no helper methods.
-	handlers map[string][]EventHandler
-	plugins  map[string]Plugin
+	// main bot thread. They have no helper methods. Command handlers are kept
+	// in handlers too, under commandKey(name), so that each message only
+	// runs the handlers for its own command.
+	handlers   map[string][]handlerEntry
+	plugins    map[string]Plugin
+	priority   int           // for handlers registered without a Priority option
+	claimed    bool          // whether an addressed handler took the current message
+	handlerSeq int           // how many handlers have been registered
+	command    parsedCommand // the last command line parsed (see commandArgs)
+
+	// The times of the bot's recent messages in each channel, and the
+	// channels where it seems to be in a loop (see loopHandler).
+	ownMessages map[string][]time.Time
+	throttled   map[string]time.Time
+
+	// These are only used while configuring plugins. While collecting, config
+	// errors are saved in configErrors rather than being fatal.
+	configuring  string
+	collecting   bool
+	validating   bool
+	skipBroken   bool
+	configErrors ConfigErrors
 }
 
 /*
@@ -65,24 +156,68 @@ receives the server's "hello" event.
 func newBot() *Bot {
 	Log := logrus.New()
 	Log.Level = logrus.DebugLevel
+	ctx, cancel := context.WithCancel(context.Background())
 	bot := &Bot{
 		API:           nil,
 		RTM:           nil,
 		Log:           Log,
-		userByName:    make(map[string]*slack.User),
-		userByID:      make(map[string]*slack.User),
+		channels:      make(map[string]*channelInfo),
 		channelByName: make(map[string]string),
-		channelByID:   make(map[string]string),
+		userGroups:    make(map[string]*slack.UserGroup),
+		groupByHandle: make(map[string]string),
 		state:         make(map[string][]byte),
-		stateChan:     make(chan pluginStateEvent, 100),
 		plugins:       make(map[string]Plugin),
-		handlers:      make(map[string][]EventHandler),
+		handlers:      make(map[string][]handlerEntry),
+		clock:         systemClock{},
+		timerHandlers: make(map[string]TimerHandler),
+		timerJobs:     make(map[string]*armedTimer),
+		conversations: make(map[string]*Conversation),
+		tracked:       make(map[string]*trackedMessage),
+		replyAcks:     make(map[int]string),
+		msgCache:      make(map[string]*slack.Msg),
+		ownMessages:   make(map[string][]time.Time),
+		throttled:     make(map[string]time.Time),
+		ctx:           ctx,
+		cancel:        cancel,
+		timeout:       defaultCommandTimeout,
+		timeouts:      make(map[string]time.Duration),
 	}
+	bot.resetUsers()
+
+	// The info caches must see every event, whatever plugins do.
+	bot.priority = priorityInfo
 	bot.registerInfoHandlers()
+	bot.OnEvent("hello", startScheduler)
+	bot.OnEvent("ack", bot.ackHandler)
+	bot.OnEvent("message", bot.loopHandler)
+	bot.priority = 0
 	bot.OnCommand("help", helpCommand)
+	bot.OnFallback(unknownCommand, Priority(priorityUnknown))
 	return bot
 }
 
+/*
+The priority of the bot's own handlers, which keep the info caches up to date.
+*/
+const priorityInfo = math.MaxInt32
+
+/*
+A registered EventHandler, along with its priority and the plugin which
+registered it (empty for the bot's own handlers). seq is the order in which
+handlers were registered, which breaks ties in priority.
+*/
+type handlerEntry struct {
+	handler  EventHandler
+	priority int
+	seq      int
+	plugin   string
+	fallback bool
+	edits    bool
+	inPlace  bool // with edits, update the first reply instead of deleting it
+	messages bool // a message handler, which ignores bots unless bots is set
+	bots     bool
+}
+
 /*
 Register an EventHandler to be called whenever a specific type of Slack RTM
 event occurs. You can register the same EventHandler to multiple events with
@@ -100,9 +235,45 @@ hierarchy of handlers and registration functions.
           -> CommandHandler, OnCommand()
        -> MessageHandler, OnMatch()
        -> MessageHandler, OnMatchExpr()
+       -> MessageHandler, OnFallback()
+    -> ReactionHandler, OnReaction()
+    -> ReactionHandler, OnReactionRemoved()
+
+Every registration function takes options, like Priority(). Handlers run in
+order of priority, highest first, and in the order they were registered when
+their priorities are equal. A handler can return Handled to stop the handlers
+after it from seeing the event.
 */
-func (bot *Bot) OnEvent(type_ string, eh EventHandler) {
-	bot.handlers[type_] = append(bot.handlers[type_], eh)
+func (bot *Bot) OnEvent(type_ string, eh EventHandler, opts ...HandlerOption) {
+	bot.addHandler(type_, handlerEntry{handler: eh}, opts)
+}
+
+/*
+Add a handler, keeping the handlers sorted by priority.
+*/
+func (bot *Bot) addHandler(type_ string, entry handlerEntry, opts []HandlerOption) {
+	entry.priority = bot.priority
+	entry.plugin = bot.configuring
+	entry.seq = bot.handlerSeq
+	bot.handlerSeq++
+	for _, opt := range opts {
+		opt(&entry)
+	}
+	if entry.messages {
+		entry.handler = bot.botFilter(entry.handler, entry.bots)
+	}
+	if entry.edits {
+		entry.handler = bot.editsHandler(entry.handler, entry.inPlace)
+	}
+	handlers := bot.handlers[type_]
+	i := len(handlers)
+	for i > 0 && handlers[i-1].priority < entry.priority {
+		i--
+	}
+	handlers = append(handlers, handlerEntry{})
+	copy(handlers[i+1:], handlers[i:])
+	handlers[i] = entry
+	bot.handlers[type_] = handlers
 }
 
 /*
@@ -110,44 +281,68 @@ Register a MessageHandler to be called whenever a specific subtype of the
 "message" event occurs: https://api.slack.com/events/message
 
 Use an empty subType ("") for normal messages (i.e., none of those subtypes).
+Messages from bots, including this one, are ignored unless the AllowBots()
+option is given. A handler for the "bot_message" subtype wants bot messages by
+definition, so it gets that option automatically.
 */
-func (bot *Bot) OnMessage(subType string, mh MessageHandler) {
-	bot.OnEvent("message", func(bot *Bot, evt slack.RTMEvent) error {
-		msgEvent := evt.Data.(*slack.MessageEvent)
-		if msgEvent.Msg.SubType == subType {
-			return mh(bot, msgEvent)
-		} else {
-			return nil
-		}
-	})
+func (bot *Bot) OnMessage(subType string, mh MessageHandler, opts ...HandlerOption) {
+	bot.onMessage(subType, mh, opts)
+}
+
+/*
+The OnMessage() family of functions filter messages before calling the handler.
+For the addressed ones, global middleware (see Use) goes between the filters and
+the handler, so it only sees messages the handler would have handled. So each of
+these functions is split into an exported one, which adds the middleware, and
+one like this, which does the filtering.
+*/
+func (bot *Bot) onMessage(subType string, mh MessageHandler, opts []HandlerOption) {
+	bot.addHandler("message", messageEntry(subType, mh), opts)
+}
+
+func messageEntry(subType string, mh MessageHandler) handlerEntry {
+	return handlerEntry{
+		handler: func(bot *Bot, evt slack.RTMEvent) error {
+			msgEvent := evt.Data.(*slack.MessageEvent)
+			if msgEvent.Msg.SubType == subType {
+				return mh(bot, msgEvent)
+			} else {
+				return nil
+			}
+		},
+		messages: true,
+		bots:     subType == "bot_message",
+	}
 }
 
 /*
 Register a MessageHandler to be called when a message comes in (subtype "") and
 it is addressed to the bot. The definition of "addressed" depends on the
 situation. In a channel or group, this is a message that begins with the bot
-username or an @mention of the bot, followed by an optional colon and whitespace.
-In a direct message, any message is considered "addressed" to the bot.
+username (or one of its nicknames, in any case) or an @mention of the bot,
+followed by an optional colon and whitespace, or a message that begins with the
+prefix from the config file, like "!issue". In a direct message, any message is
+considered "addressed" to the bot.
 
 Unlike a regular handler registered with OnMessage(), the event.Msg.Text field
 is modified so that it only includes the text after the part that "addresses"
 the message to the bot. So a message like "@slacksoc: hello there" would become
 "hello there" for a handler registered with OnAddressed()
 */
-func (bot *Bot) OnAddressed(mh MessageHandler) {
-	bot.OnMessage("", func(bot *Bot, evt *slack.MessageEvent) error {
-		// We need to compile the regex *here* because when plugins register
-		// their handlers, the User/Team fields have not been initialized yet.
-		// Could optimize this by placing the compiled regex into a struct field
-		// which is initialized by the hello message handler.
-		re := regexp.MustCompile(fmt.Sprintf(
-			`\s*(<@%s(\|\w+)?>|@?%s)(?:,|:)?\s+`, bot.User.ID, bot.User.Name,
-		))
-		match := re.FindAllStringIndex(evt.Msg.Text, 1)
-		if match != nil && match[0][0] == 0 {
+func (bot *Bot) OnAddressed(mh MessageHandler, opts ...HandlerOption) {
+	bot.onAddressed(bot.claim(bot.withMiddleware(mh)), opts)
+}
+
+func (bot *Bot) onAddressed(mh MessageHandler, opts []HandlerOption) {
+	bot.onMessage("", bot.addressedFilter(mh), opts)
+}
+
+func (bot *Bot) addressedFilter(mh MessageHandler) MessageHandler {
+	return func(bot *Bot, evt *slack.MessageEvent) error {
+		if rest, ok := bot.addressedText(evt.Msg.Text); ok {
 			// replace Msg.Text, but restore it after
 			oldText := evt.Msg.Text
-			evt.Msg.Text = evt.Msg.Text[match[0][1]:]
+			evt.Msg.Text = rest
 			rv := mh(bot, evt)
 			evt.Msg.Text = oldText
 			return rv
@@ -156,123 +351,389 @@ func (bot *Bot) OnAddressed(mh MessageHandler) {
 			return mh(bot, evt)
 		}
 		return nil
-	})
+	}
+}
+
+/*
+Mark the current message as claimed whenever an addressed handler gets past its
+filters, so that OnFallback() handlers know it was understood.
+*/
+func (bot *Bot) claim(mh MessageHandler) MessageHandler {
+	return func(b *Bot, evt *slack.MessageEvent) error {
+		bot.claimed = true
+		return mh(b, evt)
+	}
+}
+
+/*
+Register a MessageHandler to be called for a message addressed to the bot (see
+OnAddressed) which no other handler claimed: that is, none of the OnAddressed()
+family of handlers matched it, and no handler returned Handled. This is the
+place to reply "Sorry, I don't understand":
+
+    bot.OnFallback(lib.Reply("Sorry, I don't understand."))
+
+*/
+func (bot *Bot) OnFallback(mh MessageHandler, opts ...HandlerOption) {
+	filtered := bot.addressedFilter(bot.withMiddleware(mh))
+	bot.addHandler("message", handlerEntry{
+		handler: func(bot *Bot, evt slack.RTMEvent) error {
+			msgEvent := evt.Data.(*slack.MessageEvent)
+			if msgEvent.Msg.SubType != "" {
+				return nil
+			}
+			return filtered(bot, msgEvent)
+		},
+		fallback: true,
+		messages: true,
+	}, opts)
+}
+
+/*
+Build the regex which matches the start of a message addressed to the bot: an
+@mention, or its username or one of its nicknames, in any case. This can't be
+done when plugins register their handlers, since the User field hasn't been
+initialized yet, so the hello handler calls it.
+*/
+func (bot *Bot) compileAddressed() {
+	names := []string{regexp.QuoteMeta(bot.User.Name)}
+	for _, nickname := range bot.nicknames {
+		names = append(names, regexp.QuoteMeta(nickname))
+	}
+	bot.addressRegexp = regexp.MustCompile(fmt.Sprintf(
+		`^(?i)\s*(<@%s(\|\w+)?>|@?(%s))(?:,|:)?\s+`,
+		regexp.QuoteMeta(bot.User.ID), strings.Join(names, "|"),
+	))
+}
+
+/*
+If text begins by addressing the bot (see OnAddressed), return the rest of the
+text and true. Otherwise, return false.
+*/
+func (bot *Bot) addressedText(text string) (string, bool) {
+	if bot.addressRegexp == nil {
+		return "", false // we haven't received hello yet
+	}
+	if rest, ok := bot.prefixedText(text); ok {
+		return rest, true
+	}
+	match := bot.addressRegexp.FindStringIndex(text)
+	if match != nil {
+		return text[match[1]:], true
+	}
+	return "", false
+}
+
+/*
+If the config file sets a prefix, and text begins with it followed by a letter
+or digit (so that "!!!" doesn't count), return the rest of the text and true.
+*/
+func (bot *Bot) prefixedText(text string) (string, bool) {
+	if bot.prefix == "" || len(text) <= len(bot.prefix) ||
+		!strings.EqualFold(text[:len(bot.prefix)], bot.prefix) {
+		return "", false
+	}
+	rest := text[len(bot.prefix):]
+	first, _ := utf8.DecodeRuneInString(rest)
+	if !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		return "", false
+	}
+	return rest, true
 }
 
 /*
 Register a MessageHandler to be called whenever a message (subtype "") matches a
 regular expression. The message need not be addressed to the bot.
 */
-func (bot *Bot) OnMatch(regex string, mh MessageHandler) {
-	bot.OnMessage("", IfMatch(regex, mh))
+func (bot *Bot) OnMatch(regex string, mh MessageHandler, opts ...HandlerOption) {
+	bot.onMessage("", IfMatch(regex, mh), opts)
 }
 
 /*
 Same as Bot.OnMatch, but takes a compiled regex.
 */
-func (bot *Bot) OnMatchExpr(expr *regexp.Regexp, mh MessageHandler) {
-	bot.OnMessage("", IfMatchExpr(expr, mh))
+func (bot *Bot) OnMatchExpr(expr *regexp.Regexp, mh MessageHandler, opts ...HandlerOption) {
+	bot.onMessage("", IfMatchExpr(expr, mh), opts)
 }
 
 /*
 Register a MessageHandler to be called whenever a message (subtype "") addressed
 to the bot matches a regular expression.
 */
-func (bot *Bot) OnAddressedMatch(regex string, mh MessageHandler) {
-	bot.OnAddressed(IfMatch(regex, mh))
+func (bot *Bot) OnAddressedMatch(regex string, mh MessageHandler, opts ...HandlerOption) {
+	bot.onAddressed(IfMatch(regex, bot.claim(bot.withMiddleware(mh))), opts)
 }
 
 /*
 Same as Bot.OnAddressedMatch, but takes a compiled regex.
 */
-func (bot *Bot) OnAddressedMatchExpr(expr *regexp.Regexp, mh MessageHandler) {
-	bot.OnAddressed(IfMatchExpr(expr, mh))
+func (bot *Bot) OnAddressedMatchExpr(expr *regexp.Regexp, mh MessageHandler, opts ...HandlerOption) {
+	bot.onAddressed(IfMatchExpr(expr, bot.claim(bot.withMiddleware(mh))), opts)
 }
 
 /*
 Register a CommandHandler to be called when a message addressed to the bot is a
 particular command. The handler receives parsed arguments, assuming that the
 first argument is cmd. See the documentation for CommandHandler for more details.
+
+Command handlers are indexed by name, so each message is only parsed once, and
+only the handlers for its command run, however many commands are registered.
+They still run in order of priority with the other message handlers.
 */
-func (bot *Bot) OnCommand(cmd string, ch CommandHandler) {
-	bot.OnAddressed(func(bot *Bot, evt *slack.MessageEvent) error {
-		args, err := shlex.Split(evt.Msg.Text)
-		if err != nil {
-			return nil // bad command line syntax is not an error :)
-		}
-		if args[0] == cmd {
-			return ch(bot, evt, args)
+func (bot *Bot) OnCommand(cmd string, ch CommandHandler, opts ...HandlerOption) {
+	ch = bot.withCommandMiddleware(ch)
+	bot.addHandler(commandKey(cmd), messageEntry("", bot.addressedFilter(
+		func(bot *Bot, evt *slack.MessageEvent) error {
+			args := bot.commandArgs(evt.Msg.Text)
+			if len(args) > 0 && args[0] == cmd {
+				bot.claimed = true
+				return ch(bot, evt, append([]string(nil), args...))
+			}
+			return nil
+		})), opts)
+}
+
+/*
+The key in bot.handlers for the handlers of a command. RTM event types never
+contain spaces, so these can't clash.
+*/
+func commandKey(cmd string) string {
+	return "command " + cmd
+}
+
+/*
+A command line, and the arguments it was split into (nil if it couldn't be).
+*/
+type parsedCommand struct {
+	text string
+	args []string
+}
+
+/*
+Split the text of an addressed message into arguments. The result is saved, so
+that the dispatcher and each command handler don't all split the same text.
+Don't modify the result. Bad command line syntax just results in no arguments.
+*/
+func (bot *Bot) commandArgs(text string) []string {
+	if bot.command.args != nil && bot.command.text == text {
+		return bot.command.args
+	}
+	args, err := splitCommand(text)
+	if err != nil {
+		args = nil // bad command line syntax is not an error :)
+	}
+	bot.command = parsedCommand{text: text, args: args}
+	return args
+}
+
+/*
+Return the command which a message event is addressed to the bot with, or "" if
+it isn't a command. Edited messages count as the command they were edited to,
+for the HandleEdits() option.
+*/
+func (bot *Bot) commandName(evt slack.RTMEvent) string {
+	msg, ok := evt.Data.(*slack.MessageEvent)
+	if !ok {
+		return ""
+	}
+	text := msg.Msg.Text
+	if msg.Msg.SubType == "message_changed" && msg.SubMessage != nil {
+		text = msg.SubMessage.Text
+	} else if msg.Msg.SubType != "" {
+		return ""
+	}
+	rest, ok := bot.addressedText(text)
+	if !ok && !IsDM(msg.Msg.Channel) {
+		return ""
+	} else if !ok {
+		rest = text
+	}
+	args := bot.commandArgs(rest)
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+/*
+Merge two lists of handlers, each in order of priority (and registration), into
+one.
+*/
+func mergeHandlers(a, b []handlerEntry) []handlerEntry {
+	merged := make([]handlerEntry, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].priority > a[0].priority ||
+			(b[0].priority == a[0].priority && b[0].seq < a[0].seq) {
+			merged = append(merged, b[0])
+			b = b[1:]
+		} else {
+			merged = append(merged, a[0])
+			a = a[1:]
 		}
-		return nil
-	})
+	}
+	return append(append(merged, a...), b...)
 }
 
 /*
-This function saves state if necessary.
+Save the state file if the state is dirty. The state map is only locked while it
+is being encoded, so plugins are not blocked while the file is written. The file
+is written to a temporary name and renamed into place, so a crash mid-save
+can't leave a truncated state file behind.
 */
-func (bot *Bot) saveState() {
-	file, err := os.Create(bot.stateFile)
+func (bot *Bot) saveState() error {
+	bot.saveLock.Lock()
+	defer bot.saveLock.Unlock()
+
+	var buf bytes.Buffer
+	bot.stateLock.Lock()
+	if !bot.stateDirty {
+		bot.stateLock.Unlock()
+		return nil
+	}
+	if bot.stateTimer != nil {
+		bot.stateTimer.Stop()
+		bot.stateTimer = nil
+	}
+	err := gob.NewEncoder(&buf).Encode(bot.state)
+	bot.stateDirty = false
+	bot.stateLock.Unlock()
+	if err == nil {
+		err = writeFileAtomic(bot.stateFile, buf.Bytes())
+	}
 	if err != nil {
 		bot.Log.WithFields(logrus.Fields{
 			"error":    err,
 			"filename": bot.stateFile,
-		}).Error("Error opening statefile for save. Continuing.")
-		return
+		}).Error("Error saving statefile. Will retry.")
+		bot.stateLock.Lock()
+		bot.markDirty(saveRetryDelay)
+		bot.stateLock.Unlock()
+		return err
 	}
+	bot.Log.Info("Saved state to ", bot.stateFile)
+	return nil
+}
 
-	enc := gob.NewEncoder(file)
-	enc.Encode(bot.state)
-	file.Close()
-	bot.stateDirty = false
+/*
+Write data to filename by way of a temporary file in the same directory.
+*/
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 /*
-This function starts the Slack RTM connection and runs the bot "forever".
+How long to wait before retrying a state save which failed.
+*/
+const saveRetryDelay = 30 * time.Second
+
+/*
+Mark the state dirty and, if it wasn't already, schedule a save after delay.
+The caller must hold stateLock.
+*/
+func (bot *Bot) markDirty(delay time.Duration) {
+	if bot.stateDirty {
+		return // a save is already scheduled
+	}
+	bot.stateDirty = true
+	bot.stateTimer = time.AfterFunc(delay, func() {
+		bot.saveState()
+	})
+}
+
+/*
+Set (or delete, if data is nil) a single entry in the state map, and queue a
+save if the state has just become dirty. This never blocks on the main loop, so
+it is safe to call from any goroutine, including from within a handler.
+*/
+func (bot *Bot) setState(key string, data []byte) {
+	bot.stateLock.Lock()
+	if data == nil {
+		delete(bot.state, key)
+	} else {
+		bot.state[key] = data
+	}
+	bot.markDirty(time.Duration(bot.stateDelay) * time.Second)
+	bot.stateLock.Unlock()
+}
+
+/*
+Immediately save any pending state changes to the state file, rather than
+waiting for the save delay to elapse. This blocks until the file has been
+written, and returns any error from writing it. It is safe to call from any
+goroutine.
+*/
+func (bot *Bot) Flush() error {
+	return bot.saveState()
+}
+
+/*
+This function starts the Slack RTM connection and runs the bot "forever", or
+until it receives SIGINT or SIGTERM.
 */
 func (bot *Bot) runForever() {
 	bot.RTM = bot.API.NewRTM()
 	go bot.RTM.ManageConnection()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	for {
+		var evt slack.RTMEvent
 		select {
-		case evt := <-bot.RTM.IncomingEvents:
-			handlers := bot.handlers[evt.Type]
-			bot.Log.WithFields(logrus.Fields{
-				"type": evt.Type,
-			}).Info("Handling a message.")
-			for _, handler := range handlers {
-				handler(bot, evt)
+		case evt = <-bot.RTM.IncomingEvents:
+		case sig := <-signals:
+			bot.shutdown(sig)
+			return
+		}
+		handlers := bot.handlers[evt.Type]
+		bot.Log.WithFields(logrus.Fields{
+			"type": evt.Type,
+		}).Info("Handling a message.")
+		if bot.deliverReply(evt) {
+			continue // it was a reply to a conversation
+		}
+		bot.dispatch(evt, handlers)
+	}
+}
+
+/*
+Run the handlers for an event, in order, until one returns Handled. After them,
+fallback handlers run (in order of their own priorities), but only if nothing
+claimed the message. Errors are logged.
+*/
+func (bot *Bot) dispatch(evt slack.RTMEvent, handlers []handlerEntry) {
+	bot.claimed = false
+	if evt.Type == "message" {
+		if cmd := bot.commandName(evt); cmd != "" {
+			handlers = mergeHandlers(handlers, bot.handlers[commandKey(cmd)])
+		}
+	}
+	for _, fallback := range []bool{false, true} {
+		for _, entry := range handlers {
+			if entry.fallback != fallback || (fallback && bot.claimed) {
+				continue
 			}
-			break
-		case state := <-bot.stateChan:
-			if state.Type == "save" {
-				bot.Log.Info("Saving state to ", bot.stateFile)
-				bot.saveState()
-			} else if state.Type == "update" {
-				bot.Log.WithFields(logrus.Fields{
-					"plugin": state.Plugin,
-				}).Info("Received state update")
-				bot.state[state.Plugin] = state.State
-				if !bot.stateDirty {
-					// only queue a new save when the state /becomes/ dirty
-					bot.stateDirty = true
-					go func() {
-						time.Sleep(time.Duration(bot.stateDelay) * time.Second)
-						bot.stateChan <- pluginStateEvent{Type: "save"}
-					}()
-				}
-			} else {
+			err := entry.handler(bot, evt)
+			if err == Handled {
+				bot.claimed = true
+				return
+			} else if err != nil {
 				bot.Log.WithFields(logrus.Fields{
-					"type": state.Type,
-				}).Warn("Unknown state event encountered.")
+					"type":   evt.Type,
+					"plugin": entry.plugin,
+					"error":  err,
+				}).Error("Handler failed.")
 			}
-			break
 		}
 	}
 }
 
 /*
-Create and run a bot object using command line arguments. Currently, one command
+Create and run a bot object using command line arguments. Normally, one command
 line argument is expected: the path of a YAML configuration file. The
 configuration file should at least contain the following:
 
@@ -282,6 +743,27 @@ configuration file should at least contain the following:
         # put any additional plugin configuration here
       - name: NextPluginName
 
+Before the file is parsed, ${NAME} is replaced by the environment variable NAME,
+${NAME:-default} provides a default for it, and ${file:/path} is replaced by the
+contents of a file (such as a Docker secret). Use $${ for a literal "${".
+
+If any plugin has configuration errors, they are all printed and the bot exits.
+With the --skip-broken flag, the bot logs them and starts without the broken
+plugins instead.
+
+On SIGINT or SIGTERM, the bot cancels the contexts it has given to plugins (see
+Context and CommandContext), waits a few seconds for commands to finish, saves
+the state file and returns.
+
+A few subcommands are also available. They work offline, without connecting to
+Slack:
+
+    slacksoc validate CONFIG             # check config for all plugins
+    slacksoc config sample               # print a commented sample config
+    slacksoc state dump CONFIG [PLUGIN]  # print plugin state as JSON
+    slacksoc state load CONFIG [FILE]    # replace state from JSON (or stdin)
+    slacksoc state clear CONFIG PLUGIN   # delete one plugin's state
+
 Since Go does not allow dynamic loading, all Plugins must be registered before
 this function is invoked. If you use only the core plugins provided, the
 slacksoc binary is good enough. If you are creating your own bot, you will need
@@ -300,14 +782,41 @@ an example:
 */
 func Run() {
 	if len(os.Args) < 2 {
-		fmt.Printf("usage: %s CONFIG\n", os.Args[0])
+		usage()
+		return
+	}
+	switch os.Args[1] {
+	case "state":
+		os.Exit(stateCommand(os.Args[2:]))
+	case "validate":
+		os.Exit(validateCommand(os.Args[2:]))
+	case "config":
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Usage = usage
+	skipBroken := flags.Bool("skip-broken", false, "")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() != 1 {
+		usage()
 		return
 	}
+
 	bot := newBot()
-	err := bot.configure(os.Args[1])
+	bot.skipBroken = *skipBroken
+	err := bot.configure(flags.Arg(0))
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 	bot.runForever()
 }
+
+func usage() {
+	fmt.Printf("usage: %s [--skip-broken] CONFIG\n", os.Args[0])
+	fmt.Printf("       %s validate CONFIG\n", os.Args[0])
+	fmt.Printf("       %s config sample\n", os.Args[0])
+	fmt.Printf("       %s state dump CONFIG [PLUGIN]\n", os.Args[0])
+	fmt.Printf("       %s state load CONFIG [FILE]\n", os.Args[0])
+	fmt.Printf("       %s state clear [CONFIG] PLUGIN\n", os.Args[0])
+}
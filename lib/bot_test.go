@@ -0,0 +1,114 @@
+package lib
+
+import "fmt"
+import "io/ioutil"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/nlopes/slack"
+
+var testStart = time.Date(2017, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+/*
+Create a bot for tests, which doesn't log and whose clock is a ManualClock
+starting at testStart. It acts as though it has connected as @slacksoc, but it
+has no connection, so handlers mustn't use the API.
+*/
+func newTestBot() (*Bot, *ManualClock) {
+	bot := newBot()
+	bot.Log.Out = ioutil.Discard
+	clock := NewManualClock(testStart)
+	bot.SetClock(clock)
+	bot.User = &slack.UserDetails{ID: "U0BOT", Name: "slacksoc"}
+	bot.compileAddressed()
+	return bot, clock
+}
+
+/*
+Dispatch a message from a user to the bot's handlers, as if it came from Slack.
+*/
+func sendMessage(bot *Bot, user, channel, text string) {
+	bot.dispatch(slack.RTMEvent{
+		Type: "message",
+		Data: &slack.MessageEvent{Msg: slack.Msg{
+			Type: "message", User: user, Channel: channel, Text: text,
+			Timestamp: "1488371400.000100",
+		}},
+	}, bot.handlers["message"])
+}
+
+/*
+Create a test bot with as many commands and triggers as a large deployment:
+commands "cmd0" through "cmd299", and OnMatch triggers "trigger0" through
+"trigger99".
+*/
+func newBenchmarkBot() *Bot {
+	bot, _ := newTestBot()
+	for i := 0; i < 300; i++ {
+		bot.OnCommand(fmt.Sprintf("cmd%d", i),
+			func(bot *Bot, evt *slack.MessageEvent, args []string) error {
+				return nil
+			})
+	}
+	for i := 0; i < 100; i++ {
+		bot.OnMatch(fmt.Sprintf(`(?i)\btrigger%d\b`, i),
+			func(bot *Bot, evt *slack.MessageEvent) error {
+				return nil
+			})
+	}
+	return bot
+}
+
+func benchmarkDispatch(b *testing.B, channel, text string) {
+	bot := newBenchmarkBot()
+	evt := slack.RTMEvent{
+		Type: "message",
+		Data: &slack.MessageEvent{Msg: slack.Msg{
+			Type: "message", User: "U1", Channel: channel, Text: text,
+			Timestamp: "1488371400.000100",
+		}},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bot.command = parsedCommand{} // as if each message were new
+		bot.dispatch(evt, bot.handlers["message"])
+	}
+}
+
+func BenchmarkDispatchCommand(b *testing.B) {
+	benchmarkDispatch(b, "C1", `@slacksoc cmd150 "some argument" another`)
+}
+
+func BenchmarkDispatchCommandDM(b *testing.B) {
+	benchmarkDispatch(b, "D1", `cmd299 "some argument" another`)
+}
+
+func BenchmarkDispatchChatter(b *testing.B) {
+	benchmarkDispatch(b, "C1", "just chatting about nothing in particular")
+}
+
+func BenchmarkDispatchTrigger(b *testing.B) {
+	benchmarkDispatch(b, "C1", "this one says trigger99 at the end")
+}
+
+func TestCommandDispatch(t *testing.T) {
+	bot, _ := newTestBot()
+	var got []string
+	for _, cmd := range []string{"issue", "potato", "deploy"} {
+		cmd := cmd
+		bot.OnCommand(cmd, func(bot *Bot, evt *slack.MessageEvent, args []string) error {
+			got = append(got, cmd+":"+strings.Join(args[1:], ","))
+			return nil
+		})
+	}
+	sendMessage(bot, "U1", "C1", `slacksoc: potato "pass it" on`)
+	sendMessage(bot, "U1", "D1", "issue me")
+	sendMessage(bot, "U1", "C1", "deploy now") // not addressed
+	sendMessage(bot, "U1", "C1", "@slacksoc deploy")
+	want := []string{"potato:pass it,on", "issue:me", "deploy:"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands ran %q, expected %q", got, want)
+	}
+}
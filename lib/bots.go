@@ -0,0 +1,101 @@
+package lib
+
+/*
+This file implements filtering of messages from bots (including this one) out of
+message handlers, and the loop detection that backs it up for handlers which
+want to see bot messages anyway.
+*/
+
+import "time"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+If the bot posts more than loopLimit messages to a channel within loopWindow, it
+is probably answering itself (or another bot) in a loop, so bot messages in that
+channel are ignored for loopCooldown.
+*/
+const (
+	loopLimit    = 5
+	loopWindow   = 10 * time.Second
+	loopCooldown = time.Minute
+)
+
+/*
+A HandlerOption which lets a message handler see messages from bots, including
+this one. By default, the OnMessage() family ignores them, so that a handler
+can't end up answering the bot's own replies or another bot forever. Even with
+this option, bot messages are ignored in a channel where the bot seems to be
+stuck in a loop.
+*/
+func AllowBots() HandlerOption {
+	return func(entry *handlerEntry) {
+		entry.bots = true
+	}
+}
+
+/*
+Return true if a message was posted by a bot, or by this bot.
+*/
+func (bot *Bot) isBotMessage(msg *slack.MessageEvent) bool {
+	return msg.Msg.User == bot.User.ID || msg.Msg.BotID != "" ||
+		msg.Msg.SubType == "bot_message"
+}
+
+/*
+Wrap the EventHandler of a message handler, so that it doesn't see messages from
+bots. If allow is true (see AllowBots), it only misses them while the channel is
+throttled for a loop.
+*/
+func (bot *Bot) botFilter(eh EventHandler, allow bool) EventHandler {
+	return func(b *Bot, evt slack.RTMEvent) error {
+		msg, ok := evt.Data.(*slack.MessageEvent)
+		if ok && bot.isBotMessage(msg) && (!allow || bot.loopThrottled(msg.Msg.Channel)) {
+			return nil
+		}
+		return eh(b, evt)
+	}
+}
+
+/*
+Return true if bot messages in a channel are being ignored because of a loop.
+*/
+func (bot *Bot) loopThrottled(channel string) bool {
+	until, ok := bot.throttled[channel]
+	if ok && bot.Now().After(until) {
+		delete(bot.throttled, channel)
+		return false
+	}
+	return ok
+}
+
+/*
+This handler counts the bot's own messages in each channel, and throttles the
+channel when there are too many of them.
+*/
+func (bot *Bot) loopHandler(_ *Bot, evt slack.RTMEvent) error {
+	msg, ok := evt.Data.(*slack.MessageEvent)
+	if !ok || msg.Msg.User != bot.User.ID || msg.Msg.SubType != "" {
+		return nil
+	}
+	channel := msg.Msg.Channel
+	now := bot.Now()
+	recent := bot.ownMessages[channel][:0]
+	for _, t := range bot.ownMessages[channel] {
+		if now.Sub(t) < loopWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	bot.ownMessages[channel] = recent
+	if len(recent) > loopLimit && !bot.loopThrottled(channel) {
+		bot.throttled[channel] = now.Add(loopCooldown)
+		bot.Log.WithFields(logrus.Fields{
+			"channel":  channel,
+			"messages": len(recent),
+			"cooldown": loopCooldown,
+		}).Warn("Bot may be replying to itself, ignoring bot messages in channel.")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package lib
+
+import "testing"
+
+import "github.com/nlopes/slack"
+
+func TestBotMessages(t *testing.T) {
+	bot, _ := newTestBot()
+	var plain, allowed, subtype int
+	bot.OnMessage("", func(bot *Bot, evt *slack.MessageEvent) error {
+		plain++
+		return nil
+	})
+	bot.OnMessage("", func(bot *Bot, evt *slack.MessageEvent) error {
+		allowed++
+		return nil
+	}, AllowBots())
+	bot.OnMessage("bot_message", func(bot *Bot, evt *slack.MessageEvent) error {
+		subtype++
+		return nil
+	})
+
+	sendMessage(bot, "U0BOT", "C1", "my own message")
+	bot.dispatch(slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: slack.Msg{
+		Type: "message", SubType: "bot_message", BotID: "B1", Channel: "C1",
+		Text: "from an integration",
+	}}}, bot.handlers["message"])
+	if plain != 0 {
+		t.Errorf("handler without AllowBots() saw %d bot messages", plain)
+	}
+	if allowed != 1 {
+		t.Errorf("handler with AllowBots() saw %d bot messages, expected 1", allowed)
+	}
+	if subtype != 1 {
+		t.Errorf("bot_message handler saw %d messages, expected 1", subtype)
+	}
+}
@@ -0,0 +1,469 @@
+package lib
+
+/*
+This file implements the bot's cache of conversations: public channels, private
+channels, group DMs and DMs. It is loaded when the bot connects, and kept up to
+date from RTM events after that.
+*/
+
+import "sort"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+The types of conversation in the Channel.Type field.
+*/
+const (
+	ChannelPublic  = "channel" // public channel
+	ChannelPrivate = "group"   // private channel
+	ChannelGroupDM = "mpim"    // multi-person direct message
+	ChannelDM      = "im"      // direct message
+)
+
+/*
+This type represents a conversation that can be returned by the Bot. Members are
+tracked too, but since a channel can have lots of them, they are looked up
+separately with GetChannelMembers() and IsMember(). Slack only tells the bot who
+the members are for conversations the bot is in (Joined).
+*/
+type Channel struct {
+	Name     string // empty for DMs
+	ID       string
+	Type     string // ChannelPublic, ChannelPrivate, ChannelGroupDM or ChannelDM
+	User     string // for a DM, the ID of the other user
+	Topic    string
+	Purpose  string
+	Archived bool
+	Joined   bool // whether the bot is a member
+}
+
+/*
+A Channel in the cache, along with its members (nil if they aren't known).
+*/
+type channelInfo struct {
+	Channel
+	members map[string]bool
+}
+
+func memberSet(ids []string) map[string]bool {
+	members := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		members[id] = true
+	}
+	return members
+}
+
+func channelFromSlack(ch *slack.Channel) *channelInfo {
+	info := &channelInfo{Channel: Channel{
+		Name:     ch.Name,
+		ID:       ch.ID,
+		Type:     ChannelPublic,
+		Topic:    ch.Topic.Value,
+		Purpose:  ch.Purpose.Value,
+		Archived: ch.IsArchived,
+		Joined:   ch.IsMember,
+	}}
+	if IsGroup(ch.ID) {
+		// (group_joined events describe private channels with this type)
+		info.Type = ChannelPrivate
+		if ch.IsMpIM {
+			info.Type = ChannelGroupDM
+		}
+		info.Joined = true
+	}
+	if info.Joined {
+		info.members = memberSet(ch.Members)
+	}
+	return info
+}
+
+func groupFromSlack(g *slack.Group) *channelInfo {
+	info := &channelInfo{Channel: Channel{
+		Name:     g.Name,
+		ID:       g.ID,
+		Type:     ChannelPrivate,
+		Topic:    g.Topic.Value,
+		Purpose:  g.Purpose.Value,
+		Archived: g.IsArchived,
+		Joined:   true, // the bot only sees private channels it is in
+	}}
+	if g.IsMpIM {
+		info.Type = ChannelGroupDM
+	}
+	info.members = memberSet(g.Members)
+	return info
+}
+
+func (bot *Bot) dmInfo(id, user string) *channelInfo {
+	return &channelInfo{
+		Channel: Channel{ID: id, Type: ChannelDM, User: user, Joined: true},
+		members: memberSet([]string{bot.User.ID, user}),
+	}
+}
+
+/*
+Add or replace a conversation in the cache. The caller must hold infoLock.
+*/
+func (bot *Bot) putChannel(info *channelInfo) {
+	if old, ok := bot.channels[info.ID]; ok && old.Name != "" {
+		delete(bot.channelByName, old.Name)
+	}
+	bot.channels[info.ID] = info
+	if info.Name != "" {
+		bot.channelByName[info.Name] = info.ID
+	}
+}
+
+/*
+Remove a conversation from the cache. The caller must hold infoLock.
+*/
+func (bot *Bot) removeChannel(id string) {
+	if old, ok := bot.channels[id]; ok && old.Name != "" {
+		delete(bot.channelByName, old.Name)
+	}
+	delete(bot.channels, id)
+}
+
+/*
+Load every conversation from the info the RTM API gives us on connecting. This
+replaces the whole cache, so it is correct after a reconnect too. The caller
+must hold infoLock.
+*/
+func (bot *Bot) loadChannels(info *slack.Info) {
+	bot.channels = make(map[string]*channelInfo)
+	bot.channelByName = make(map[string]string)
+	for i := range info.Channels {
+		bot.putChannel(channelFromSlack(&info.Channels[i]))
+	}
+	for i := range info.Groups {
+		bot.putChannel(groupFromSlack(&info.Groups[i]))
+	}
+	for _, im := range info.IMs {
+		bot.putChannel(bot.dmInfo(im.ID, im.User))
+	}
+}
+
+/*
+Run update on a cached conversation, if it exists, while holding infoLock.
+*/
+func (bot *Bot) updateChannel(id string, update func(info *channelInfo)) {
+	bot.infoLock.Lock()
+	if info, ok := bot.channels[id]; ok {
+		update(info)
+	}
+	bot.infoLock.Unlock()
+}
+
+/*
+This handler listens for channel_created events and adds the channel.
+*/
+func (bot *Bot) channelCreatedHandler(_ *Bot, evt slack.RTMEvent) error {
+	created := evt.Data.(*slack.ChannelCreatedEvent)
+	bot.Log.WithFields(logrus.Fields{
+		"name": created.Channel.Name, "id": created.Channel.ID,
+	}).Info("handling channel_created event")
+	bot.infoLock.Lock()
+	bot.putChannel(&channelInfo{Channel: Channel{
+		Name: created.Channel.Name, ID: created.Channel.ID, Type: ChannelPublic,
+	}})
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for channel_deleted events and deletes the channel.
+*/
+func (bot *Bot) channelDeletedHandler(_ *Bot, evt slack.RTMEvent) error {
+	del := evt.Data.(*slack.ChannelDeletedEvent)
+	bot.Log.WithFields(logrus.Fields{
+		"id": del.Channel,
+	}).Info("handling channel_deleted event")
+	bot.infoLock.Lock()
+	bot.removeChannel(del.Channel)
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for channel_joined and group_joined events, which come
+with full info (including members) on the conversation the bot joined.
+*/
+func (bot *Bot) channelJoinedHandler(_ *Bot, evt slack.RTMEvent) error {
+	var channel *slack.Channel
+	switch joined := evt.Data.(type) {
+	case *slack.ChannelJoinedEvent:
+		channel = &joined.Channel
+	case *slack.GroupJoinedEvent:
+		channel = &joined.Channel
+	default:
+		return nil
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"name": channel.Name, "id": channel.ID,
+	}).Info("handling " + evt.Type + " event")
+	info := channelFromSlack(channel)
+	info.Joined = true
+	info.members = memberSet(channel.Members)
+	bot.infoLock.Lock()
+	bot.putChannel(info)
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for channel_left events. The channel is still there, but
+we no longer hear about its members.
+*/
+func (bot *Bot) channelLeftHandler(_ *Bot, evt slack.RTMEvent) error {
+	left := evt.Data.(*slack.ChannelLeftEvent)
+	bot.Log.WithFields(logrus.Fields{
+		"id": left.Channel,
+	}).Info("handling channel_left event")
+	bot.updateChannel(left.Channel, func(info *channelInfo) {
+		info.Joined = false
+		info.members = nil
+	})
+	return nil
+}
+
+/*
+This handler listens for group_left events. The bot can't see private channels
+it isn't in, so the channel is removed.
+*/
+func (bot *Bot) groupLeftHandler(_ *Bot, evt slack.RTMEvent) error {
+	left := evt.Data.(*slack.GroupLeftEvent)
+	bot.Log.WithFields(logrus.Fields{
+		"id": left.Channel,
+	}).Info("handling group_left event")
+	bot.infoLock.Lock()
+	bot.removeChannel(left.Channel)
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for channel_rename and group_rename events.
+*/
+func (bot *Bot) channelRenameHandler(_ *Bot, evt slack.RTMEvent) error {
+	var id, name string
+	switch rename := evt.Data.(type) {
+	case *slack.ChannelRenameEvent:
+		id, name = rename.Channel.ID, rename.Channel.Name
+	case *slack.GroupRenameEvent:
+		id, name = rename.Group.ID, rename.Group.Name
+	default:
+		return nil
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"name": name, "id": id,
+	}).Info("handling " + evt.Type + " event")
+	bot.infoLock.Lock()
+	if info, ok := bot.channels[id]; ok {
+		renamed := *info
+		renamed.Name = name
+		bot.putChannel(&renamed)
+	}
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for the channel_archive, channel_unarchive, group_archive
+and group_unarchive events.
+*/
+func (bot *Bot) channelArchiveHandler(_ *Bot, evt slack.RTMEvent) error {
+	var id string
+	archived := false
+	switch archive := evt.Data.(type) {
+	case *slack.ChannelArchiveEvent:
+		id, archived = archive.Channel, true
+	case *slack.GroupArchiveEvent:
+		id, archived = archive.Channel, true
+	case *slack.ChannelUnarchiveEvent:
+		id = archive.Channel
+	case *slack.GroupUnarchiveEvent:
+		id = archive.Channel
+	default:
+		return nil
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"id": id,
+	}).Info("handling " + evt.Type + " event")
+	bot.updateChannel(id, func(info *channelInfo) {
+		info.Archived = archived
+	})
+	return nil
+}
+
+/*
+This handler listens for im_created events and adds the DM.
+*/
+func (bot *Bot) imCreatedHandler(_ *Bot, evt slack.RTMEvent) error {
+	created := evt.Data.(*slack.IMCreatedEvent)
+	bot.Log.WithFields(logrus.Fields{
+		"user": created.User, "id": created.Channel.ID,
+	}).Info("handling im_created event")
+	bot.infoLock.Lock()
+	bot.putChannel(bot.dmInfo(created.Channel.ID, created.User))
+	bot.infoLock.Unlock()
+	return nil
+}
+
+/*
+This handler listens for member_joined_channel and member_left_channel events,
+and updates the member set.
+*/
+func (bot *Bot) memberChangeHandler(_ *Bot, evt slack.RTMEvent) error {
+	var id, user string
+	joined := false
+	switch change := evt.Data.(type) {
+	case *slack.MemberJoinedChannelEvent:
+		id, user, joined = change.Channel, change.User, true
+	case *slack.MemberLeftChannelEvent:
+		id, user = change.Channel, change.User
+	default:
+		return nil
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"user": user, "id": id,
+	}).Info("handling " + evt.Type + " event")
+	bot.updateChannel(id, func(info *channelInfo) {
+		if info.members == nil {
+			return // we don't know the rest of the members anyway
+		}
+		if joined {
+			info.members[user] = true
+		} else {
+			delete(info.members, user)
+		}
+	})
+	return nil
+}
+
+/*
+This handler listens for the messages Slack posts when a channel's topic or
+purpose is changed.
+*/
+func (bot *Bot) channelTopicHandler(_ *Bot, evt slack.RTMEvent) error {
+	msg := evt.Data.(*slack.MessageEvent)
+	switch msg.Msg.SubType {
+	case "channel_topic", "group_topic":
+		bot.updateChannel(msg.Msg.Channel, func(info *channelInfo) {
+			info.Topic = msg.Msg.Topic
+		})
+	case "channel_purpose", "group_purpose":
+		bot.updateChannel(msg.Msg.Channel, func(info *channelInfo) {
+			info.Purpose = msg.Msg.Purpose
+		})
+	}
+	return nil
+}
+
+func (bot *Bot) registerChannelHandlers() {
+	bot.OnEvent("channel_created", bot.channelCreatedHandler)
+	bot.OnEvent("channel_deleted", bot.channelDeletedHandler)
+	bot.OnEvent("channel_joined", bot.channelJoinedHandler)
+	bot.OnEvent("group_joined", bot.channelJoinedHandler)
+	bot.OnEvent("channel_left", bot.channelLeftHandler)
+	bot.OnEvent("group_left", bot.groupLeftHandler)
+	bot.OnEvent("channel_rename", bot.channelRenameHandler)
+	bot.OnEvent("group_rename", bot.channelRenameHandler)
+	bot.OnEvent("channel_archive", bot.channelArchiveHandler)
+	bot.OnEvent("channel_unarchive", bot.channelArchiveHandler)
+	bot.OnEvent("group_archive", bot.channelArchiveHandler)
+	bot.OnEvent("group_unarchive", bot.channelArchiveHandler)
+	bot.OnEvent("im_created", bot.imCreatedHandler)
+	bot.OnEvent("member_joined_channel", bot.memberChangeHandler)
+	bot.OnEvent("member_left_channel", bot.memberChangeHandler)
+	bot.OnEvent("message", bot.channelTopicHandler)
+}
+
+/*
+Return a channel's name from its ID. Returns empty string if the channel id does
+not exist. Can be called safely from any goroutine.
+*/
+func (bot *Bot) GetChannelByID(id string) string {
+	bot.infoLock.RLock()
+	var channelName string
+	if info, ok := bot.channels[id]; ok {
+		channelName = info.Name
+	}
+	bot.infoLock.RUnlock()
+	return channelName
+}
+
+/*
+Return a channel's ID from its name. Returns empty string if the channel name
+does not exist. Private channels may be found by name too. Can be called safely
+from any goroutine.
+*/
+func (bot *Bot) GetChannelByName(name string) string {
+	bot.infoLock.RLock()
+	channelID := bot.channelByName[name]
+	bot.infoLock.RUnlock()
+	return channelID
+}
+
+/*
+Return a copy of the cached info on a conversation, or nil if it isn't known.
+Can be called safely from any goroutine.
+*/
+func (bot *Bot) GetChannel(id string) *Channel {
+	bot.infoLock.RLock()
+	defer bot.infoLock.RUnlock()
+	info, ok := bot.channels[id]
+	if !ok {
+		return nil
+	}
+	channel := info.Channel
+	return &channel
+}
+
+/*
+Return a slice of every conversation the bot knows about: all public channels,
+and the private channels, group DMs and DMs which the bot is in. Check the Type
+field to tell them apart. The slice, and the Channels, can be modified safely.
+This function can be called safely from any goroutine.
+*/
+func (bot *Bot) GetChannels() []Channel {
+	bot.infoLock.RLock()
+	channels := make([]Channel, 0, len(bot.channels))
+	for _, info := range bot.channels {
+		channels = append(channels, info.Channel)
+	}
+	bot.infoLock.RUnlock()
+	return channels
+}
+
+/*
+Return the sorted IDs of a conversation's members. Returns nil if the members
+aren't known, which is the case for public channels the bot isn't in. Can be
+called safely from any goroutine.
+*/
+func (bot *Bot) GetChannelMembers(id string) []string {
+	bot.infoLock.RLock()
+	defer bot.infoLock.RUnlock()
+	info, ok := bot.channels[id]
+	if !ok || info.members == nil {
+		return nil
+	}
+	members := make([]string, 0, len(info.members))
+	for member := range info.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+/*
+Return true if a user is a member of a conversation. This is always false if the
+members of the conversation aren't known (see GetChannelMembers). Can be called
+safely from any goroutine.
+*/
+func (bot *Bot) IsMember(channel, user string) bool {
+	bot.infoLock.RLock()
+	defer bot.infoLock.RUnlock()
+	info, ok := bot.channels[channel]
+	return ok && info.members[user]
+}
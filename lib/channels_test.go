@@ -0,0 +1,114 @@
+package lib
+
+import "reflect"
+import "testing"
+
+import "github.com/nlopes/slack"
+
+/*
+Return a test bot whose cache holds #general (which the bot is in, with U1 and
+U2), #random (which it isn't in) and a private channel, #secret.
+*/
+func newChannelBot() *Bot {
+	bot, _ := newTestBot()
+	var general, random slack.Channel
+	general.ID, general.Name, general.IsMember = "C1", "general", true
+	general.Members = []string{"U1", "U2"}
+	random.ID, random.Name = "C2", "random"
+	var secret slack.Group
+	secret.ID, secret.Name, secret.Members = "G1", "secret", []string{"U1"}
+	bot.loadChannels(&slack.Info{
+		Channels: []slack.Channel{general, random},
+		Groups:   []slack.Group{secret},
+	})
+	return bot
+}
+
+func TestLoadChannels(t *testing.T) {
+	bot := newChannelBot()
+	if id := bot.GetChannelByName("secret"); id != "G1" {
+		t.Errorf("GetChannelByName(\"secret\") = %q", id)
+	}
+	if ch := bot.GetChannel("G1"); ch == nil || ch.Type != ChannelPrivate || !ch.Joined {
+		t.Errorf("GetChannel(\"G1\") = %+v", ch)
+	}
+	if members := bot.GetChannelMembers("C1"); !reflect.DeepEqual(members, []string{"U1", "U2"}) {
+		t.Errorf("#general members = %q", members)
+	}
+	if members := bot.GetChannelMembers("C2"); members != nil {
+		t.Errorf("#random members = %q, expected nil since the bot isn't in it", members)
+	}
+	if len(bot.GetChannels()) != 3 {
+		t.Errorf("GetChannels() = %+v", bot.GetChannels())
+	}
+}
+
+func TestChannelRename(t *testing.T) {
+	bot := newChannelBot()
+	bot.channelRenameHandler(bot, slack.RTMEvent{
+		Type: "channel_rename",
+		Data: &slack.ChannelRenameEvent{Channel: slack.ChannelRenameInfo{
+			ID: "C1", Name: "lobby",
+		}},
+	})
+	if id := bot.GetChannelByName("general"); id != "" {
+		t.Errorf("old name still maps to %q", id)
+	}
+	if id := bot.GetChannelByName("lobby"); id != "C1" {
+		t.Errorf("GetChannelByName(\"lobby\") = %q", id)
+	}
+	if name := bot.GetChannelByID("C1"); name != "lobby" {
+		t.Errorf("GetChannelByID(\"C1\") = %q", name)
+	}
+	if !bot.IsMember("C1", "U2") {
+		t.Errorf("members were lost in the rename")
+	}
+
+	bot.channelRenameHandler(bot, slack.RTMEvent{
+		Type: "group_rename",
+		Data: &slack.GroupRenameEvent{Group: slack.GroupRenameInfo{
+			ID: "G1", Name: "hush",
+		}},
+	})
+	if id := bot.GetChannelByName("hush"); id != "G1" {
+		t.Errorf("GetChannelByName(\"hush\") = %q", id)
+	}
+}
+
+func TestChannelMembers(t *testing.T) {
+	bot := newChannelBot()
+	bot.memberChangeHandler(bot, slack.RTMEvent{
+		Type: "member_joined_channel",
+		Data: &slack.MemberJoinedChannelEvent{User: "U3", Channel: "C1"},
+	})
+	bot.memberChangeHandler(bot, slack.RTMEvent{
+		Type: "member_left_channel",
+		Data: &slack.MemberLeftChannelEvent{User: "U1", Channel: "C1"},
+	})
+	if members := bot.GetChannelMembers("C1"); !reflect.DeepEqual(members, []string{"U2", "U3"}) {
+		t.Errorf("#general members = %q, expected U2 and U3", members)
+	}
+
+	// The bot doesn't know who else is in #random, so it doesn't start now.
+	bot.memberChangeHandler(bot, slack.RTMEvent{
+		Type: "member_joined_channel",
+		Data: &slack.MemberJoinedChannelEvent{User: "U3", Channel: "C2"},
+	})
+	if bot.IsMember("C2", "U3") || bot.GetChannelMembers("C2") != nil {
+		t.Errorf("members of #random became known from one join")
+	}
+
+	bot.channelLeftHandler(bot, slack.RTMEvent{
+		Type: "channel_left", Data: &slack.ChannelLeftEvent{Channel: "C1"},
+	})
+	if ch := bot.GetChannel("C1"); ch == nil || ch.Joined || bot.IsMember("C1", "U2") {
+		t.Errorf("after leaving, #general is %+v, members %q", ch,
+			bot.GetChannelMembers("C1"))
+	}
+	bot.groupLeftHandler(bot, slack.RTMEvent{
+		Type: "group_left", Data: &slack.GroupLeftEvent{Channel: "G1"},
+	})
+	if bot.GetChannel("G1") != nil || bot.GetChannelByName("secret") != "" {
+		t.Errorf("private channel still cached after leaving it")
+	}
+}
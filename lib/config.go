@@ -1,12 +1,16 @@
 package lib
 
+import "bytes"
 import "encoding/gob"
+import "errors"
 import "fmt"
-import "io/ioutil"
 import "github.com/mitchellh/mapstructure"
 import "log"
 import "os"
-import "gopkg.in/yaml.v2"
+import "reflect"
+import "regexp"
+import "strings"
+import "time"
 import "github.com/sirupsen/logrus"
 import "github.com/nlopes/slack"
 
@@ -48,76 +52,206 @@ mapstructure docs: https://godoc.org/github.com/mitchellh/mapstructure
 type PluginConfig map[string]interface{}
 
 /*
-The plugins section of the bot config file is just a list of these.
+The plugins section of the bot config file is just a list of these. Priority is
+the default priority of the plugin's handlers (see lib.Priority). The file and
+line are where the entry came from, for error messages.
 */
 type pluginConfigEntry struct {
-	Name   string
-	Config PluginConfig `yaml:",omitempty,inline"`
+	Name     string
+	Priority int          `yaml:",omitempty"`
+	Config   PluginConfig `yaml:",omitempty,inline"`
+	file     string
+	line     int
+	keys     map[string][]keyOrigin // where each key was configured
 }
 
 /*
-This structure represents the configuration file used to configure the bot.
+Where a key of a plugin entry was configured. A list merged from several entries
+has an origin for each part, starting at element offset.
+*/
+type keyOrigin struct {
+	file   string
+	line   int
+	offset int
+}
+
+/*
+This structure represents the configuration file used to configure the bot. The
+desc tags document it in the sample config (see RegisterConfig).
 */
 type botConfig struct {
-	Token     string
-	StateFile string
-	SaveDelay int
-	Plugins   []pluginConfigEntry
+	Token      string              `required:"true" example:"\"${SLACK_TOKEN}\"" desc:"Go into \"Custom Integrations\" and create a bot! This is its API token."`
+	StateFile  string              `yaml:"stateFile" default:"state.gob" desc:"This is where plugins will store their state."`
+	SaveDelay  int                 `yaml:"saveDelay" default:"0" desc:"How many seconds to wait after a state change before saving the state file."`
+	Include    []string            `example:"[]" desc:"Other config files to load after this one, relative to this file. Their settings override this file's, and their plugins are added after this file's."`
+	PluginsDir string              `yaml:"pluginsDir" example:"\"\"" desc:"A directory (like \"plugins.d\") of *.yaml files to load last, in alphabetical order. Each may be a whole config file or just a list of plugin entries."`
+	Roles      map[string][]string `example:"{}" desc:"Roles, and the usernames (or user IDs) that have them, like {admin: [alice, bob]}. Plugins can restrict commands to a role with lib.RequireRole(). The admin role also includes the Slack team's admins and owners."`
+	Prefix     string              `example:"\"\"" desc:"A short prefix, like \"!\", which addresses a message to the bot, so that \"!issue\" works like \"@slacksoc issue\"."`
+	Nicknames  []string            `example:"[]" desc:"Other names the bot answers to, besides its username. Names are matched without regard to case."`
+	Unknown    string              `yaml:"unknownCommands" default:"suggest" desc:"What to do when a message addressed to the bot isn't a command it knows: \"suggest\" similar commands if there are any, always \"reply\", or \"off\"."`
+	UnknownIn  map[string]string   `yaml:"unknownCommandsIn" example:"{}" desc:"Override unknownCommands in some channels, given by name or ID, like this: {general: \"off\"}."`
+	Timeout    int                 `yaml:"commandTimeout" default:"30" desc:"How many seconds a command may spend on calls to other services (like GitHub) before they are cancelled."`
+	Timeouts   map[string]int      `yaml:"commandTimeouts" example:"{}" desc:"Override commandTimeout for particular commands, like {issue: 60}."`
+	Plugins    []pluginConfigEntry
 	// more configuration information will likely go here
 }
 
-func (b *Bot) initLoadState(filename string) error {
-	file, err := os.Open(filename)
+/*
+Before stateFile and saveDelay were documented in camel case, yaml.v2 expected
+them in lower case, so accept those spellings too.
+*/
+func (c *botConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain botConfig // without this method, to avoid recursion
+	err := unmarshal((*plain)(c))
 	if err != nil {
-		return nil // we will use empty state if it doesn't exist
+		return err
 	}
-
-	dec := gob.NewDecoder(file)
-	err = dec.Decode(&b.state)
+	var legacy struct {
+		StateFile string `yaml:"statefile"`
+		SaveDelay int    `yaml:"savedelay"`
+	}
+	err = unmarshal(&legacy)
 	if err != nil {
 		return err
 	}
+	if c.StateFile == "" {
+		c.StateFile = legacy.StateFile
+	}
+	if c.SaveDelay == 0 {
+		c.SaveDelay = legacy.SaveDelay
+	}
 	return nil
 }
 
 /*
-This loads a configuration file, sets any configuration values in the Bot, and
-then initializes all plugins. To clarify, this configure() function is private
-and it is for configuring the whole bot and loading the plugins.
+Read a state file into a map. A missing file is not an error; it just results
+in empty state.
 */
-func (b *Bot) configure(filename string) error {
-	var config botConfig
-
-	// Unmarshal the bot config from YAML.
+func readStateFile(filename string) (map[string][]byte, error) {
+	state := make(map[string][]byte)
 	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return state, nil // we will use empty state if it doesn't exist
 	}
+	defer file.Close()
 
-	arr, err := ioutil.ReadAll(file)
+	dec := gob.NewDecoder(file)
+	err = dec.Decode(&state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/*
+Write a state map to a state file, replacing its contents.
+*/
+func writeStateFile(filename string, state map[string][]byte) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(state)
 	if err != nil {
 		return err
 	}
+	return writeFileAtomic(filename, buf.Bytes())
+}
 
-	err = yaml.Unmarshal(arr, &config)
+func (b *Bot) initLoadState(filename string) error {
+	state, err := readStateFile(filename)
 	if err != nil {
 		return err
 	}
+	b.state = state
+	return nil
+}
+
+/*
+Read and parse the YAML configuration file, filling in defaults. Environment
+variables and secret files are substituted first (see interpolate). This doesn't
+touch the Bot, so it is suitable for commands which run without connecting.
+
+The configuration may be split across several files. The main file is loaded
+first, then each file in its include list (and their includes, depth first),
+and finally the files in pluginsDir. Settings from later files override earlier
+ones, and plugin entries are added in the order they're loaded. Entries for the
+same plugin are merged (see mergePlugins), so a long list of Respond triggers
+can be split across files.
+*/
+func loadConfig(filename string) (*botConfig, error) {
+	var config botConfig
+	seen := make(map[string]bool)
+
+	err := loadConfigTree(&config, filename, seen)
+	if err != nil {
+		return nil, err
+	}
+	if config.PluginsDir != "" {
+		err = loadPluginsDir(&config, config.PluginsDir, seen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config.Plugins, err = mergePlugins(config.Plugins)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get the bot state filename and unmarshal it.
 	if config.StateFile == "" {
 		config.StateFile = "state.gob"
 	}
+	if config.Unknown == "" {
+		config.Unknown = unknownSuggest
+	}
+	if config.Timeout == 0 {
+		config.Timeout = int(defaultCommandTimeout / time.Second)
+	}
+	return &config, nil
+}
+
+/*
+This loads a configuration file, sets any configuration values in the Bot, and
+then initializes all plugins. To clarify, this configure() function is private
+and it is for configuring the whole bot and loading the plugins.
+*/
+func (b *Bot) configure(filename string) error {
+	b.collecting = true
+	defer func() { b.collecting = false }()
+
+	config, err := loadConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	// Get the bot state filename and unmarshal it.
 	b.Log.Info("State file: ", config.StateFile)
 	b.stateDelay = config.SaveDelay
+	b.roles = config.Roles
+	b.prefix = config.Prefix
+	b.nicknames = config.Nicknames
+	b.configureUnknown(config)
+	b.timeout = time.Duration(config.Timeout) * time.Second
+	if config.Timeout < 0 {
+		b.ConfigError(&PluginConfigError{
+			Key: "commandTimeout", Err: errors.New("must be positive"),
+		})
+	}
+	for cmd, seconds := range config.Timeouts {
+		b.timeouts[cmd] = time.Duration(seconds) * time.Second
+		if seconds <= 0 {
+			b.ConfigError(&PluginConfigError{
+				Key: "commandTimeouts." + cmd, Err: errors.New("must be positive"),
+			})
+		}
+	}
 	b.stateFile = config.StateFile
 	err = b.initLoadState(config.StateFile)
 	if err != nil {
 		return err
 	}
 
-	if config.Token == "" {
-		config.Token = os.Getenv("SLACK_TOKEN")
+	if config.Token == "" && b.validating {
+		b.ConfigError(&PluginConfigError{
+			Key: "token", Err: errors.New("missing Slack token"),
+		})
 	}
 
 	API := slack.New(config.Token)
@@ -126,19 +260,159 @@ func (b *Bot) configure(filename string) error {
 	b.API = API
 
 	for _, entry := range config.Plugins {
+		before := len(b.configErrors)
 		ctor, ok := plugins[entry.Name]
-		if !ok {
-			return fmt.Errorf("config error: plugin %s not found", entry.Name)
+		if ok {
+			b.loadPlugin(ctor, entry)
+		} else {
+			b.ConfigError(&PluginConfigError{
+				File: entry.file, Line: entry.line,
+				Err: fmt.Errorf("plugin %s not found", entry.Name),
+			})
 		}
-		plugin := ctor(b, entry.Name, entry.Config)
-		if plugin == nil {
-			return fmt.Errorf("error loading plugin %s", entry.Name)
+		if len(b.configErrors) > before && b.skipBroken {
+			for _, err := range b.configErrors[before:] {
+				b.Log.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("Skipping broken plugin.")
+			}
+			b.configErrors = b.configErrors[:before]
 		}
-		b.plugins[entry.Name] = plugin
+	}
+	if len(b.configErrors) > 0 {
+		return b.configErrors
 	}
 	return nil
 }
 
+/*
+Construct a single plugin. If it reports any errors, they are collected in
+b.configErrors and the plugin is not added to the bot. Handlers registered by a
+broken plugin (and any middleware, jobs and timer handler it added) are removed
+again, so that if we carry on without it (see --skip-broken), none of its code
+runs.
+*/
+func (b *Bot) loadPlugin(ctor PluginConstructor, entry pluginConfigEntry) {
+	before := len(b.configErrors)
+	middleware := len(b.middleware)
+
+	b.configuring = entry.Name
+	b.priority = entry.Priority
+	plugin, err := ctor(b, entry.Name, entry.Config)
+	if err != nil {
+		b.ConfigError(err)
+	} else if plugin == nil {
+		b.ConfigError(errors.New("constructor returned no plugin"))
+	}
+	b.configuring = ""
+	b.priority = 0
+	for _, err := range b.configErrors[before:] {
+		if perr, ok := err.(*PluginConfigError); ok && perr.File == "" {
+			perr.File, perr.Line = entry.location(perr.Key)
+		}
+	}
+
+	if len(b.configErrors) == before {
+		b.plugins[entry.Name] = plugin
+		return
+	}
+	b.middleware = b.middleware[:middleware]
+	for type_, handlers := range b.handlers {
+		kept := handlers[:0]
+		for _, handler := range handlers {
+			if handler.plugin != entry.Name {
+				kept = append(kept, handler)
+			}
+		}
+		b.handlers[type_] = kept
+	}
+	b.cancelJobs(entry.Name)
+}
+
+/*
+PluginConfigError describes a single problem with the bot configuration. Plugin
+is the name of the plugin whose configuration contained the problem, and Key is
+the path to the configuration key which was wrong, like "responses[2].trigger".
+File and Line are where the plugin's entry begins in the config files. Any of
+these may be empty if they don't apply.
+*/
+type PluginConfigError struct {
+	File   string
+	Line   int
+	Plugin string
+	Key    string
+	Err    error
+}
+
+func (e *PluginConfigError) Error() string {
+	msg := e.Err.Error()
+	if e.Key != "" {
+		msg = e.Key + ": " + msg
+	}
+	if e.Plugin != "" {
+		msg = "plugin " + e.Plugin + ": " + msg
+	}
+	if e.File != "" && e.Line > 0 {
+		msg = fmt.Sprintf("%s:%d: %s", e.File, e.Line, msg)
+	} else if e.File != "" {
+		msg = e.File + ": " + msg
+	}
+	return msg
+}
+
+/*
+ConfigErrors is a list of configuration errors, which is itself an error. This
+is returned when there's more than one problem to report, so that users can fix
+everything at once instead of one error per restart.
+*/
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+/*
+Report a configuration error. Plugin constructors may use this for problems
+with their configuration which Configure() can't detect on its own (for
+instance, a value which fails to parse), when they would rather carry on than
+return an error right away. After reporting an error, constructors should
+continue as best they can, skipping whatever was broken, so that every problem
+is found in one go.
+
+During startup, errors are collected and the bot refuses to start once every
+plugin has been constructed (or, with --skip-broken, leaves out the plugins with
+errors). When called from a plugin constructor, the plugin name is added to the
+error. Outside of startup, this is fatal.
+*/
+func (b *Bot) ConfigError(err error) {
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, err := range errs {
+			b.ConfigError(err)
+		}
+		return
+	}
+	var perr PluginConfigError
+	if e, ok := err.(*PluginConfigError); ok {
+		perr = *e
+	} else {
+		perr.Err = err
+	}
+	if perr.Plugin == "" {
+		perr.Plugin = b.configuring
+	}
+	if b.collecting {
+		b.configErrors = append(b.configErrors, &perr)
+		return
+	}
+	b.Log.WithFields(logrus.Fields{
+		"error": &perr,
+	}).Fatal("Configuration error.")
+}
+
 /*
 Return true if a slice of strings contains a string. This ends up being such a
 handy method that plugins will want to use it.
@@ -158,10 +432,43 @@ configuration object did not contain a top-level key listed in "required". Also
 raise an error if the configuration object contained any keys which were not
 successfully loaded into the struct, since this is probably not intended.
 
-Any error causes a crash, so the caller does not need to handle any errors.
+If the plugin registered the type of dest with RegisterConfig(), fields tagged
+required:"true" are required too, and missing keys get their default values.
+
+Errors are reported with ConfigError(), so the caller does not need to handle
+any errors. If you'd rather handle them yourself, use DecodeConfig().
 */
 func (b *Bot) Configure(config PluginConfig, dest interface{}, required []string) {
+	err := b.DecodeConfig(config, dest, required)
+	if err != nil {
+		b.ConfigError(err)
+	}
+}
+
+/*
+Matches the quoted key path at the start of most mapstructure error messages,
+and the list of keys in its "invalid keys" message.
+*/
+var mapstructureKeyRegexp = regexp.MustCompile(`^(?:error decoding )?'([^']*)':? (.*)$`)
+var mapstructureUnusedRegexp = regexp.MustCompile(`^has invalid keys: (.*)$`)
+
+/*
+Same as Configure(), but returns any errors instead of reporting them. The error
+is a ConfigErrors list of *PluginConfigError, each of which has the plugin name
+and the path of the offending key. A plugin constructor may simply return this
+error, after which the bot will report it along with all the others.
+*/
+func (b *Bot) DecodeConfig(config PluginConfig, dest interface{}, required []string) error {
+	var errs ConfigErrors
 	var metadata mapstructure.Metadata
+
+	// If the plugin registered this config type, its tags supply defaults and
+	// more required keys.
+	fields := registeredConfigFields(b.configuring, dest)
+	config, err := applyConfigDefaults(b.configuring, config, fields)
+	if err != nil {
+		return err
+	}
 	decoderConfig := &mapstructure.DecoderConfig{
 		ErrorUnused: true,
 		Metadata:    &metadata,
@@ -169,21 +476,93 @@ func (b *Bot) Configure(config PluginConfig, dest interface{}, required []string
 	}
 	decoder, err := mapstructure.NewDecoder(decoderConfig)
 	if err != nil {
-		b.Log.WithFields(logrus.Fields{
-			"error": err,
-		}).Fatal("Error creating mapstructure decoder.")
+		return &PluginConfigError{Plugin: b.configuring, Err: err}
 	}
 	err = decoder.Decode(config)
-	if err != nil {
-		b.Log.WithFields(logrus.Fields{
-			"error": err,
-		}).Fatal("Error decoding plugin configuration.")
+	if merr, ok := err.(*mapstructure.Error); ok {
+		// report each problem separately, so they can all be seen at once
+		for _, msg := range merr.Errors {
+			errs = append(errs, b.decodeErrors(msg)...)
+		}
+	} else if err != nil {
+		errs = append(errs, &PluginConfigError{Plugin: b.configuring, Err: err})
 	}
+	// Even when decoding failed, dest has everything which could be decoded,
+	// so this finds the required keys in lists too.
+	required = append(requiredConfigKeys(fields, reflect.ValueOf(dest), ""),
+		required...)
 	for _, key := range required {
-		if !Contains(metadata.Keys, key) {
-			b.Log.WithFields(logrus.Fields{
-				"key": key,
-			}).Fatal("Plugin configuration missing required key.")
+		if !Contains(metadata.Keys, key) && !alreadyReported(errs, configKeyPath(key)) {
+			errs = append(errs, &PluginConfigError{
+				Plugin: b.configuring, Key: configKeyPath(key),
+				Err: errors.New("missing required key"),
+			})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+/*
+Return true if errs already has an error about a key, or about the key or list
+element containing it, so that a badly typed value isn't also reported as
+missing.
+*/
+func alreadyReported(errs ConfigErrors, key string) bool {
+	for _, err := range errs {
+		perr, ok := err.(*PluginConfigError)
+		if !ok || perr.Key == "" {
+			continue
+		}
+		if key == perr.Key || strings.HasPrefix(key, perr.Key+".") ||
+			strings.HasPrefix(key, perr.Key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Turn a mapstructure error message into one or more PluginConfigErrors. The
+message is rearranged so that the key path comes first, in the same case as in
+the YAML file.
+*/
+func (b *Bot) decodeErrors(msg string) []error {
+	match := mapstructureKeyRegexp.FindStringSubmatch(msg)
+	if match == nil {
+		return []error{&PluginConfigError{Plugin: b.configuring, Err: errors.New(msg)}}
+	}
+	path, rest := configKeyPath(match[1]), match[2]
+	unused := mapstructureUnusedRegexp.FindStringSubmatch(rest)
+	if unused == nil {
+		return []error{&PluginConfigError{
+			Plugin: b.configuring, Key: path, Err: errors.New(rest),
+		}}
+	}
+	var errs []error
+	for _, key := range strings.Split(unused[1], ", ") {
+		if path != "" {
+			key = path + "." + key
+		}
+		errs = append(errs, &PluginConfigError{
+			Plugin: b.configuring, Key: key, Err: errors.New("unknown key"),
+		})
+	}
+	return errs
+}
+
+/*
+Convert a mapstructure field path like "Responses[1].Trigger" into the form
+used in the config file, "responses[1].trigger".
+*/
+func configKeyPath(path string) string {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToLower(part[:1]) + part[1:]
 		}
 	}
+	return strings.Join(parts, ".")
 }
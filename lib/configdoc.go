@@ -0,0 +1,347 @@
+package lib
+
+/*
+This file implements configuration metadata: plugins register their config
+struct, and struct tags on its fields describe each key. The same metadata is
+used to generate a sample config ("slacksoc config sample") and to check for
+required keys and fill in defaults in Bot.Configure().
+*/
+
+import "bufio"
+import "fmt"
+import "io"
+import "os"
+import "reflect"
+import "strings"
+
+import "gopkg.in/yaml.v2"
+
+/*
+Internal registry of plugin config types, along with the order they were
+registered in (which is the order the sample config lists them).
+*/
+var configTypes = make(map[string]reflect.Type)
+var configOrder []string
+
+/*
+Register the type of a plugin's configuration struct (the one passed to
+Configure). The proto argument is any value of that type, or a pointer to one.
+The struct's fields may be documented with tags:
+
+    type myConfig struct {
+        ApiKey  string `required:"true" desc:"Your API key." example:"${MY_KEY}"`
+        Timeout int    `default:"30" desc:"Timeout in seconds."`
+    }
+
+  * desc is a description of the key, shown as a comment in the sample config.
+    It may contain \n to start a new line.
+  * required:"true" makes the key required, as if it were listed in the
+    required argument to Configure().
+  * default is YAML which is used when the key is missing from the config.
+  * example is YAML shown in the sample config, when there's no default.
+
+Fields may be structs, or lists of structs, which are documented the same way.
+Config keys are the field name with its first letter lower-cased, unless a
+mapstructure tag gives a different name.
+
+Like Register(), this should be called before lib.Run().
+*/
+func RegisterConfig(name string, proto interface{}) {
+	if _, ok := configTypes[name]; !ok {
+		configOrder = append(configOrder, name)
+	}
+	configTypes[name] = derefType(reflect.TypeOf(proto))
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+/*
+Metadata for a single key in a config struct.
+*/
+type configField struct {
+	Name     string // Go field name
+	Key      string // key in the config file
+	Desc     string
+	Default  string
+	Example  string
+	Required bool
+	Type     reflect.Type
+	Fields   []configField // for structs and lists of structs
+}
+
+/*
+Return the metadata for each documented key of a config struct type.
+*/
+func configFields(t reflect.Type) []configField {
+	var fields []configField
+	t = derefType(t)
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous {
+			continue // unexported fields aren't loaded by mapstructure
+		}
+		key := f.Tag.Get("mapstructure")
+		if key == "" && t == reflect.TypeOf(botConfig{}) {
+			key = f.Tag.Get("yaml") // the bot config is loaded with yaml
+		}
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(f.Name[:1]) + f.Name[1:]
+		}
+		if key == "plugins" && t == reflect.TypeOf(botConfig{}) {
+			continue // the sample generates the plugins list itself
+		}
+		field := configField{
+			Name:     f.Name,
+			Key:      key,
+			Desc:     f.Tag.Get("desc"),
+			Default:  f.Tag.Get("default"),
+			Example:  f.Tag.Get("example"),
+			Required: f.Tag.Get("required") == "true",
+			Type:     f.Type,
+		}
+		elem := derefType(f.Type)
+		if elem.Kind() == reflect.Slice {
+			elem = derefType(elem.Elem())
+		}
+		if elem.Kind() == reflect.Struct {
+			field.Fields = configFields(elem)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+/*
+Return the registered config metadata for a plugin, if the plugin registered
+the type of dest. Otherwise, returns nil.
+*/
+func registeredConfigFields(plugin string, dest interface{}) []configField {
+	t, ok := configTypes[plugin]
+	if !ok || t != derefType(reflect.TypeOf(dest)) {
+		return nil
+	}
+	return configFields(t)
+}
+
+/*
+Return the mapstructure paths of every key marked required in fields, within
+the decoded value, including within lists of structs (like
+"Responses[2].Trigger").
+*/
+func requiredConfigKeys(fields []configField, value reflect.Value, prefix string) []string {
+	var keys []string
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	for _, field := range fields {
+		path := prefix + field.Name
+		if field.Required {
+			keys = append(keys, path)
+		}
+		if field.Fields == nil {
+			continue
+		}
+		fv := value.FieldByName(field.Name)
+		for fv.Kind() == reflect.Ptr {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Slice {
+			for i := 0; i < fv.Len(); i++ {
+				keys = append(keys, requiredConfigKeys(field.Fields, fv.Index(i),
+					fmt.Sprintf("%s[%d].", path, i))...)
+			}
+		} else if fv.Kind() == reflect.Struct {
+			keys = append(keys, requiredConfigKeys(field.Fields, fv, path+".")...)
+		}
+	}
+	return keys
+}
+
+/*
+Return a copy of config with the defaults from fields filled in for any keys
+that are missing. Keys are matched case-insensitively, as mapstructure does.
+*/
+func applyConfigDefaults(plugin string, config PluginConfig, fields []configField) (PluginConfig, error) {
+	result := make(PluginConfig, len(config))
+	for key, value := range config {
+		result[key] = value
+	}
+	for _, field := range fields {
+		if field.Default == "" {
+			continue
+		}
+		found := false
+		for key := range config {
+			if strings.EqualFold(key, field.Key) {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		var value interface{}
+		err := yaml.Unmarshal([]byte(field.Default), &value)
+		if err != nil {
+			return nil, &PluginConfigError{
+				Plugin: plugin, Key: field.Key,
+				Err: fmt.Errorf("bad default: %s", err),
+			}
+		}
+		result[field.Key] = value
+	}
+	return result, nil
+}
+
+/*
+Write comment lines for a field, wrapped to fit in 80 columns.
+*/
+func writeConfigComment(w io.Writer, indent string, field configField) {
+	desc := field.Desc
+	if field.Required {
+		desc += " (required)"
+	} else if field.Default != "" {
+		desc += fmt.Sprintf(" (default: %s)", field.Default)
+	}
+	desc = strings.TrimSpace(desc)
+	width := 80 - len(indent) - 2
+	for _, paragraph := range strings.Split(desc, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line != "" && len(line)+1+len(word) > width {
+				fmt.Fprintf(w, "%s# %s\n", indent, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		if line == "" {
+			fmt.Fprintf(w, "%s#\n", indent)
+		} else {
+			fmt.Fprintf(w, "%s# %s\n", indent, line)
+		}
+	}
+}
+
+/*
+Return a placeholder YAML value for a type which has no example or default.
+*/
+func zeroConfigValue(t reflect.Type) string {
+	switch derefType(t).Kind() {
+	case reflect.String:
+		return `""`
+	case reflect.Slice, reflect.Array:
+		return "[]"
+	case reflect.Map, reflect.Struct:
+		return "{}"
+	case reflect.Bool:
+		return "false"
+	default:
+		return "0"
+	}
+}
+
+/*
+Write a commented YAML sample of a list of config fields. The first line is
+written with firstIndent rather than indent, which allows writing the first key
+of a list item on the same line as its "- ".
+*/
+func writeConfigFields(w io.Writer, firstIndent, indent string, fields []configField) {
+	for i, field := range fields {
+		prefix := indent
+		if i == 0 {
+			prefix = firstIndent
+		}
+		if field.Desc != "" || field.Required || field.Default != "" {
+			// for a list item, this goes above the "- ", which is fine
+			writeConfigComment(w, indent, field)
+		}
+		value := field.Example
+		if value == "" {
+			value = field.Default
+		}
+		if value == "" && field.Fields != nil {
+			fmt.Fprintf(w, "%s%s:\n", prefix, field.Key)
+			if derefType(field.Type).Kind() == reflect.Slice {
+				writeConfigFields(w, indent+"  - ", indent+"    ", field.Fields)
+			} else {
+				writeConfigFields(w, indent+"  ", indent+"  ", field.Fields)
+			}
+			continue
+		}
+		if value == "" {
+			value = zeroConfigValue(field.Type)
+		}
+		if strings.Contains(value, "\n") {
+			fmt.Fprintf(w, "%s%s:\n", prefix, field.Key)
+			for _, line := range strings.Split(strings.TrimRight(value, "\n"), "\n") {
+				fmt.Fprintf(w, "%s  %s\n", indent, line)
+			}
+		} else {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, field.Key, value)
+		}
+	}
+}
+
+const sampleConfigHeader = `# This file documents a sample configuration for Slacksoc. It is generated by
+# "slacksoc config sample" from the config structs of each registered plugin.
+#
+# To users: you'll need to fill in a lot of blanks in here. Usually there will
+# be a comment above each setting describing how to fill it out. You may also
+# just want to eliminate some of the plugin entries if you don't need them.
+#
+# Any value may be taken from the environment or from a file, which is handy for
+# secrets. These substitutions happen anywhere in the file, before it is parsed:
+#
+#   ${NAME}             environment variable NAME (it must be set)
+#   ${NAME:-default}    environment variable NAME, or "default" if unset/empty
+#   ${file:/path}       contents of a file (e.g. /run/secrets/slack_token)
+#   $${                 a literal "${"
+#
+# To developers: document your plugin's configuration with struct tags on its
+# config struct and register it with lib.RegisterConfig(), then regenerate this
+# file.
+
+`
+
+/*
+Write a commented sample config for the bot and every registered plugin.
+*/
+func writeSampleConfig(w io.Writer) {
+	fmt.Fprint(w, sampleConfigHeader)
+	writeConfigFields(w, "", "", configFields(reflect.TypeOf(botConfig{})))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# And here we specify the plugins we would like to load. Only plugins in")
+	fmt.Fprintln(w, "# this list will be loaded.")
+	fmt.Fprintln(w, "plugins:")
+	for _, name := range configOrder {
+		fmt.Fprintf(w, "  - name: %s\n", name)
+		writeConfigFields(w, "    ", "    ", configFields(configTypes[name]))
+	}
+}
+
+/*
+Implementation of "slacksoc config". Returns the process exit code.
+*/
+func configCommand(args []string) int {
+	if len(args) != 1 || args[0] != "sample" {
+		usage()
+		return 1
+	}
+	out := bufio.NewWriter(os.Stdout)
+	writeSampleConfig(out)
+	out.Flush()
+	return 0
+}
@@ -0,0 +1,113 @@
+package lib
+
+/*
+This file implements contexts for the work plugins do outside the bot, like
+calls to other services, so that it can time out, and so that it is cancelled
+when the bot shuts down.
+*/
+
+import "context"
+import "os"
+import "sync"
+import "time"
+
+import "github.com/sirupsen/logrus"
+
+/*
+How long commands get to finish after their contexts are cancelled during
+shutdown, before the state is saved and the bot exits.
+*/
+const shutdownGrace = 5 * time.Second
+
+/*
+How long commands may take, unless the config file says otherwise.
+*/
+const defaultCommandTimeout = 30 * time.Second
+
+/*
+Return a context which is cancelled when the bot shuts down. Use it for work
+which isn't part of a command, like a scheduled job. This can be called safely
+from any goroutine.
+*/
+func (bot *Bot) Context() context.Context {
+	return bot.ctx
+}
+
+/*
+Return a context for a command to pass to calls to other services, like HTTP
+requests. It is cancelled after the command's timeout (see commandTimeout and
+commandTimeouts in the config file), or when the bot shuts down, whichever is
+first. The command must call cancel when it is done, and the bot waits (briefly)
+for that when it shuts down. For example:
+
+    func (p *plugin) Fetch(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
+        go func() {
+            ctx, cancel := bot.CommandContext(args[0])
+            defer cancel()
+            req, _ := http.NewRequest("GET", p.url, nil)
+            resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+            // ...
+        }()
+        return nil
+    }
+
+This can be called safely from any goroutine.
+*/
+func (bot *Bot) CommandContext(cmd string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(bot.ctx, bot.CommandTimeout(cmd))
+	bot.ctxLock.Lock()
+	defer bot.ctxLock.Unlock()
+	if bot.closing {
+		return ctx, cancel // already cancelled; don't hold up shutdown
+	}
+	bot.inflight.Add(1)
+	var once sync.Once
+	return ctx, func() {
+		cancel()
+		once.Do(bot.inflight.Done)
+	}
+}
+
+/*
+Return how long a command may take, from the config file.
+*/
+func (bot *Bot) CommandTimeout(cmd string) time.Duration {
+	if timeout, ok := bot.timeouts[cmd]; ok {
+		return timeout
+	}
+	return bot.timeout
+}
+
+/*
+Shut the bot down after a signal: cancel every context from Context() and
+CommandContext(), give commands a moment to finish, disconnect, and save the
+state.
+*/
+func (bot *Bot) shutdown(sig os.Signal) {
+	bot.Log.WithFields(logrus.Fields{
+		"signal": sig,
+	}).Info("Shutting down.")
+	bot.ctxLock.Lock()
+	bot.closing = true
+	bot.ctxLock.Unlock()
+	bot.cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		bot.inflight.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(shutdownGrace):
+		bot.Log.Warn("Commands didn't finish in time.")
+	}
+
+	bot.RTM.Disconnect()
+	err := bot.saveState()
+	if err != nil {
+		bot.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Couldn't save state.")
+	}
+}
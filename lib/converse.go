@@ -0,0 +1,231 @@
+package lib
+
+/*
+This file implements conversations, which let a plugin ask a user a question and
+wait for the answer, rather than handling every message separately.
+*/
+
+import "errors"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+Errors returned by Conversation.Ask().
+*/
+var ErrConversationTimeout = errors.New("conversation timed out")
+var ErrConversationCancelled = errors.New("conversation cancelled")
+var ErrConversationBusy = errors.New("already waiting for a reply from this user")
+
+/*
+How long Ask() waits for a reply, unless the conversation's Timeout is changed.
+*/
+const DefaultConversationTimeout = 5 * time.Minute
+
+/*
+Conversation is an exchange with one user in one channel, created by
+bot.Converse(). Each call to Ask() sends a prompt and waits for the user's next
+message in the channel. That message is the reply: it goes only to the
+conversation, and not to any other handlers, so a reply like "yes" won't also
+trigger some plugin's OnCommand("yes").
+
+If the user replies "cancel", Ask() returns ErrConversationCancelled, and so
+does every later Ask(). The plugin may also call Cancel() itself.
+
+Ask() blocks until the reply arrives, but replies are delivered by the main bot
+goroutine, which also runs every handler. So a conversation must never run in a
+handler directly. Start a goroutine for it instead:
+
+    func (p *myPlugin) Standup(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
+        go func() {
+            conv := bot.Converse(evt.User, evt.Channel)
+            yesterday, err := conv.Ask("What did you do yesterday?")
+            if err != nil {
+                conv.Say("Never mind, then.")
+                return
+            }
+            // ...
+        }()
+        return nil
+    }
+*/
+type Conversation struct {
+	User    string
+	Channel string
+	Timeout time.Duration // for each Ask()
+
+	bot     *Bot
+	replies chan string
+	cancel  chan struct{}
+	once    sync.Once
+}
+
+/*
+Start a conversation with a user in a channel. If channel is empty, the
+conversation takes place in a direct message with the user. Nothing is sent
+until the first Ask() or Say().
+*/
+func (bot *Bot) Converse(user, channel string) *Conversation {
+	return &Conversation{
+		User:    user,
+		Channel: channel,
+		Timeout: DefaultConversationTimeout,
+		bot:     bot,
+		replies: make(chan string, 1),
+		cancel:  make(chan struct{}),
+	}
+}
+
+/*
+Open the direct message channel, for a conversation with no channel.
+*/
+func (c *Conversation) open() error {
+	if c.Channel != "" {
+		return nil
+	}
+	_, _, channel, err := c.bot.API.OpenIMChannel(c.User)
+	if err != nil {
+		return err
+	}
+	c.Channel = channel
+	return nil
+}
+
+/*
+Send a message in the conversation, without waiting for a reply.
+*/
+func (c *Conversation) Say(msg string) error {
+	err := c.open()
+	if err != nil {
+		return err
+	}
+	c.bot.Send(c.Channel, msg)
+	return nil
+}
+
+/*
+Send a prompt (unless it is empty) and return the user's reply. If the reply is
+addressed to the bot ("@slacksoc yes"), the address is removed. Returns
+ErrConversationTimeout if there is no reply within the conversation's Timeout,
+ErrConversationCancelled if the conversation was cancelled, or
+ErrConversationBusy if another conversation is already waiting for this user in
+this channel.
+*/
+func (c *Conversation) Ask(prompt string) (string, error) {
+	select {
+	case <-c.cancel:
+		return "", ErrConversationCancelled
+	default:
+	}
+	err := c.open()
+	if err != nil {
+		return "", err
+	}
+
+	// Register for the reply before sending the prompt, so a quick reply
+	// can't slip by.
+	key := conversationKey(c.User, c.Channel)
+	c.bot.convLock.Lock()
+	if _, busy := c.bot.conversations[key]; busy {
+		c.bot.convLock.Unlock()
+		return "", ErrConversationBusy
+	}
+	c.bot.conversations[key] = c
+	c.bot.convLock.Unlock()
+
+	if prompt != "" {
+		c.bot.Send(c.Channel, prompt)
+	}
+	timeout := make(chan struct{})
+	timer := c.bot.clock.AfterFunc(c.Timeout, func() { close(timeout) })
+	defer timer.Stop()
+
+	var text string
+	select {
+	case text = <-c.replies:
+	case <-timeout:
+		if !c.withdraw(key) {
+			text = <-c.replies
+			break
+		}
+		return "", ErrConversationTimeout
+	case <-c.cancel:
+		if !c.withdraw(key) {
+			text = <-c.replies
+			break
+		}
+		return "", ErrConversationCancelled
+	}
+	text = strings.TrimSpace(text)
+	if strings.EqualFold(text, "cancel") {
+		c.Cancel()
+		return "", ErrConversationCancelled
+	}
+	return text, nil
+}
+
+/*
+Stop waiting for a reply, after a timeout or cancellation. This returns false if
+the reply was delivered first, in which case it is waiting in c.replies. Since
+deliverReply() decides under the same lock, a reply is never lost: either it
+goes to the conversation, or to the bot's other handlers.
+*/
+func (c *Conversation) withdraw(key string) bool {
+	c.bot.convLock.Lock()
+	defer c.bot.convLock.Unlock()
+	if c.bot.conversations[key] != c {
+		return false
+	}
+	delete(c.bot.conversations, key)
+	return true
+}
+
+/*
+Cancel the conversation. A pending Ask() returns ErrConversationCancelled right
+away, as does any later one. This is safe to call from any goroutine, and more
+than once.
+*/
+func (c *Conversation) Cancel() {
+	c.once.Do(func() { close(c.cancel) })
+}
+
+func conversationKey(user, channel string) string {
+	return user + "/" + channel
+}
+
+/*
+If a message is the reply a conversation is waiting for, hand it over and return
+true, in which case it should not be given to any other handlers. This runs on
+the main bot goroutine, for every event.
+*/
+func (bot *Bot) deliverReply(evt slack.RTMEvent) bool {
+	msg, ok := evt.Data.(*slack.MessageEvent)
+	if !ok || evt.Type != "message" || msg.Msg.SubType != "" {
+		return false
+	}
+	key := conversationKey(msg.Msg.User, msg.Msg.Channel)
+	bot.convLock.Lock()
+	c := bot.conversations[key]
+	if c != nil {
+		// Remove the address here rather than in Ask(), since the address
+		// regexp belongs to the main goroutine (it is recompiled on hello).
+		text := msg.Msg.Text
+		if rest, ok := bot.addressedText(text); ok {
+			text = rest
+		}
+		delete(bot.conversations, key)
+		c.replies <- text // (never blocks, since only one reply is delivered per Ask)
+	}
+	bot.convLock.Unlock()
+	if c == nil {
+		return false
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"user":    msg.Msg.User,
+		"channel": msg.Msg.Channel,
+	}).Debug("Delivered reply to conversation.")
+	return true
+}
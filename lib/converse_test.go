@@ -0,0 +1,141 @@
+package lib
+
+import "testing"
+import "time"
+
+import "github.com/nlopes/slack"
+
+type askResult struct {
+	text string
+	err  error
+}
+
+/*
+Start an Ask() without a prompt on its own goroutine, as a plugin would, and
+wait until it is waiting for the reply (that is, until its timeout is set).
+*/
+func startAsk(conv *Conversation, clock *ManualClock) chan askResult {
+	clock.lock.Lock()
+	timers := len(clock.timers)
+	clock.lock.Unlock()
+
+	result := make(chan askResult, 1)
+	go func() {
+		text, err := conv.Ask("")
+		result <- askResult{text, err}
+	}()
+	for {
+		clock.lock.Lock()
+		waiting := len(clock.timers) > timers
+		clock.lock.Unlock()
+		if waiting {
+			return result
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/*
+Return a message event from a user in channel C1, as it comes from Slack.
+*/
+func replyEvent(user, text string) slack.RTMEvent {
+	return slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: slack.Msg{
+		Type: "message", User: user, Channel: "C1", Text: text,
+	}}}
+}
+
+func TestAsk(t *testing.T) {
+	bot, clock := newTestBot()
+	conv := bot.Converse("U1", "C1")
+	result := startAsk(conv, clock)
+
+	if bot.deliverReply(replyEvent("U2", "no")) {
+		t.Errorf("a message from another user was delivered")
+	}
+	if !bot.deliverReply(replyEvent("U1", "<@U0BOT>: yes ")) {
+		t.Fatalf("the reply wasn't delivered")
+	}
+	if r := <-result; r.err != nil || r.text != "yes" {
+		t.Errorf("Ask() = %q, %v, expected \"yes\"", r.text, r.err)
+	}
+	if bot.deliverReply(replyEvent("U1", "again")) {
+		t.Errorf("a second message was delivered to a finished Ask()")
+	}
+}
+
+func TestAskBusy(t *testing.T) {
+	bot, clock := newTestBot()
+	result := startAsk(bot.Converse("U1", "C1"), clock)
+	if _, err := bot.Converse("U1", "C1").Ask(""); err != ErrConversationBusy {
+		t.Errorf("second Ask() returned %v, expected ErrConversationBusy", err)
+	}
+	bot.deliverReply(replyEvent("U1", "first"))
+	if r := <-result; r.text != "first" {
+		t.Errorf("Ask() = %q, expected \"first\"", r.text)
+	}
+}
+
+func TestAskCancel(t *testing.T) {
+	bot, clock := newTestBot()
+	conv := bot.Converse("U1", "C1")
+	result := startAsk(conv, clock)
+	bot.deliverReply(replyEvent("U1", "Cancel"))
+	if r := <-result; r.err != ErrConversationCancelled {
+		t.Errorf("Ask() returned %v, expected ErrConversationCancelled", r.err)
+	}
+	if _, err := conv.Ask(""); err != ErrConversationCancelled {
+		t.Errorf("Ask() after cancelling returned %v", err)
+	}
+
+	conv = bot.Converse("U1", "C1")
+	result = startAsk(conv, clock)
+	conv.Cancel()
+	if r := <-result; r.err != ErrConversationCancelled {
+		t.Errorf("Ask() returned %v, expected ErrConversationCancelled", r.err)
+	}
+}
+
+func TestAskTimeout(t *testing.T) {
+	bot, clock := newTestBot()
+	conv := bot.Converse("U1", "C1")
+	result := startAsk(conv, clock)
+	clock.Advance(DefaultConversationTimeout)
+	if r := <-result; r.err != ErrConversationTimeout {
+		t.Errorf("Ask() returned %v, expected ErrConversationTimeout", r.err)
+	}
+	// Once Ask() has given up, messages go to the other handlers.
+	if bot.deliverReply(replyEvent("U1", "too late")) {
+		t.Errorf("a reply after the timeout was delivered")
+	}
+
+	result = startAsk(conv, clock)
+	bot.deliverReply(replyEvent("U1", "in time"))
+	if r := <-result; r.err != nil || r.text != "in time" {
+		t.Errorf("Ask() after a timeout = %q, %v", r.text, r.err)
+	}
+}
+
+/*
+When the reply and the timeout arrive together, the reply must not be lost: if
+it was delivered, Ask() returns it.
+*/
+func TestAskReplyBeatsTimeout(t *testing.T) {
+	bot, clock := newTestBot()
+	for i := 0; i < 50; i++ {
+		conv := bot.Converse("U1", "C1")
+		result := startAsk(conv, clock)
+		delivered := make(chan bool)
+		go func() {
+			delivered <- bot.deliverReply(replyEvent("U1", "yes"))
+		}()
+		clock.Advance(DefaultConversationTimeout)
+		r := <-result
+		if <-delivered {
+			if r.err != nil || r.text != "yes" {
+				t.Fatalf("reply was delivered, but Ask() = %q, %v", r.text, r.err)
+			}
+		} else if r.err != ErrConversationTimeout {
+			t.Fatalf("reply wasn't delivered, but Ask() returned %v", r.err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package lib
+
+import "testing"
+import "time"
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"* * * FOO *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	start := time.Date(2017, time.March, 1, 12, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 1, 12, 31, 0, 0, time.UTC)},
+		{"30 12 * * *", time.Date(2017, 3, 2, 12, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2017, 3, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2017, 3, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 3, 1, 13, 0, 0, 0, time.UTC)},
+		// Either the day of the month or the day of the week.
+		{"0 0 10 * FRI", time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", test.spec, err)
+			continue
+		}
+		if got := s.next(start); !got.Equal(test.want) {
+			t.Errorf("%q: next(%s) = %s, expected %s", test.spec, start, got,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package lib
+
+/*
+This file implements re-processing of edited messages for handlers registered
+with the HandleEdits() option, along with the bookkeeping that lets the bot
+delete (or update) its replies to the original message, so that they aren't
+duplicated.
+*/
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+How many recent messages the bot remembers its replies to. Replies to older
+messages are left alone when those messages are edited.
+*/
+const maxTrackedMessages = 500
+
+/*
+A message which an edit handler has seen: the bot's replies to it, and the last
+edit which was processed, so that it is only processed once.
+*/
+type trackedMessage struct {
+	replies  []string       // timestamps of the bot's replies
+	lastEdit string         // Edited.Timestamp of the last edit seen
+	handled  map[int]string // the last edit each edit handler processed
+	reuse    string         // a reply for the next Reply to update in place
+}
+
+/*
+A HandlerOption which makes the handler run again when a user edits a message,
+as if the edited message had just been sent. Before that, the bot deletes the
+replies it gave to the original message (through bot.Reply), so that there is
+only one set of answers. Edits which don't change the text, like Slack adding a
+link preview, are ignored.
+
+This works with OnCommand() and the rest of the OnMessage() family:
+
+    bot.OnCommand("echo", p.Echo, lib.HandleEdits())
+
+*/
+func HandleEdits() HandlerOption {
+	return func(entry *handlerEntry) {
+		entry.edits = true
+	}
+}
+
+/*
+Like HandleEdits, but the bot's first reply to the original message is kept,
+and the handler's first Reply to the edited message replaces its text, instead
+of being posted as a new message. Any other replies are still deleted. This
+suits a command with side effects, like filing an issue, which should update
+what it did (and say so in the same place) rather than do it again:
+
+    bot.OnCommand("issue", p.Issue, lib.HandleEditsInPlace())
+
+If the handler doesn't reply to the edited message, the first reply is left as
+it was.
+*/
+func HandleEditsInPlace() HandlerOption {
+	return func(entry *handlerEntry) {
+		entry.edits = true
+		entry.inPlace = true
+	}
+}
+
+func messageKey(channel, ts string) string {
+	return channel + "/" + ts
+}
+
+/*
+Wrap an EventHandler for the HandleEdits() option. It receives new messages as
+usual (remembering them, so that replies can be tracked), and edited messages
+unwrapped into new messages.
+*/
+func (bot *Bot) editsHandler(eh EventHandler, inPlace bool) EventHandler {
+	bot.editHandlers++
+	id := bot.editHandlers
+	return func(b *Bot, evt slack.RTMEvent) error {
+		msg, ok := evt.Data.(*slack.MessageEvent)
+		if !ok {
+			return eh(b, evt)
+		}
+		if msg.Msg.SubType == "" {
+			bot.trackMessage(messageKey(msg.Msg.Channel, msg.Msg.Timestamp))
+			return eh(b, evt)
+		}
+		if msg.Msg.SubType != "message_changed" {
+			return eh(b, evt)
+		}
+		edited := bot.unwrapEdit(msg, id, inPlace)
+		if edited == nil {
+			return nil
+		}
+		return eh(b, slack.RTMEvent{Type: evt.Type, Data: edited})
+	}
+}
+
+/*
+Turn a message_changed event into the message it changed to, for the edit
+handler with an ID. Returns nil if the edit should be ignored, including if
+this handler has already processed it. The first handler to see each edit
+deletes the bot's replies to the original message, except for the first one, if
+the handler updates replies in place.
+*/
+func (bot *Bot) unwrapEdit(msg *slack.MessageEvent, id int, inPlace bool) *slack.MessageEvent {
+	sub := msg.SubMessage
+	if sub == nil || sub.SubType != "" || sub.User == "" || sub.Edited == nil {
+		return nil
+	}
+	if msg.PreviousMessage != nil && msg.PreviousMessage.Text == sub.Text {
+		return nil // not a change to the text, just a link preview or the like
+	}
+
+	key := messageKey(msg.Msg.Channel, sub.Timestamp)
+	bot.trackLock.Lock()
+	tracked := bot.tracked[key]
+	if tracked == nil {
+		tracked = bot.trackMessageLocked(key)
+	}
+	if tracked.handled[id] == sub.Edited.Timestamp {
+		bot.trackLock.Unlock()
+		return nil
+	}
+	tracked.handled[id] = sub.Edited.Timestamp
+	var replies []string
+	if tracked.lastEdit != sub.Edited.Timestamp {
+		tracked.lastEdit = sub.Edited.Timestamp
+		replies = tracked.replies
+		if tracked.reuse != "" { // the handler didn't reply to the last edit
+			replies = append([]string{tracked.reuse}, replies...)
+			tracked.reuse = ""
+		}
+		tracked.replies = nil
+		if inPlace && len(replies) > 0 {
+			tracked.reuse = replies[0]
+			replies = replies[1:]
+		}
+	}
+	bot.trackLock.Unlock()
+
+	if len(replies) > 0 {
+		bot.Log.WithFields(logrus.Fields{
+			"channel": msg.Msg.Channel,
+			"message": sub.Timestamp,
+			"replies": len(replies),
+		}).Info("Message edited, deleting replies.")
+		go func() {
+			for _, ts := range replies {
+				_, _, err := bot.API.DeleteMessage(msg.Msg.Channel, ts)
+				if err != nil {
+					bot.Log.WithFields(logrus.Fields{
+						"channel": msg.Msg.Channel,
+						"reply":   ts,
+						"error":   err,
+					}).Warn("Couldn't delete reply to edited message.")
+				}
+			}
+		}()
+	}
+
+	edited := &slack.MessageEvent{Msg: *sub}
+	edited.Msg.Channel = msg.Msg.Channel
+	return edited
+}
+
+func (bot *Bot) trackMessage(key string) {
+	bot.trackLock.Lock()
+	if bot.tracked[key] == nil {
+		bot.trackMessageLocked(key)
+	}
+	bot.trackLock.Unlock()
+}
+
+/*
+Start tracking a message, forgetting the oldest one if there are too many. The
+caller must hold trackLock.
+*/
+func (bot *Bot) trackMessageLocked(key string) *trackedMessage {
+	tracked := &trackedMessage{handled: make(map[int]string)}
+	bot.tracked[key] = tracked
+	bot.trackOrder = append(bot.trackOrder, key)
+	if len(bot.trackOrder) > maxTrackedMessages {
+		oldest := bot.trackOrder[0]
+		bot.trackOrder = bot.trackOrder[1:]
+		delete(bot.tracked, oldest)
+		for id, pendingKey := range bot.replyAcks {
+			if pendingKey == oldest {
+				delete(bot.replyAcks, id)
+			}
+		}
+	}
+	return tracked
+}
+
+/*
+Remember that an outgoing message is a reply to evt, if evt is being tracked.
+Its timestamp arrives later, in an ack event.
+*/
+func (bot *Bot) trackReply(evt *slack.MessageEvent, id int) {
+	key := messageKey(evt.Msg.Channel, evt.Msg.Timestamp)
+	bot.trackLock.Lock()
+	if bot.tracked[key] != nil {
+		bot.replyAcks[id] = key
+	}
+	bot.trackLock.Unlock()
+}
+
+/*
+This handler listens for ack events, which confirm that a message the bot sent
+was posted, and records the timestamps of replies to tracked messages.
+*/
+func (bot *Bot) ackHandler(_ *Bot, evt slack.RTMEvent) error {
+	ack, ok := evt.Data.(*slack.AckMessage)
+	if !ok {
+		return nil
+	}
+	bot.trackLock.Lock()
+	if key, ok := bot.replyAcks[ack.ReplyTo]; ok {
+		delete(bot.replyAcks, ack.ReplyTo)
+		if tracked := bot.tracked[key]; tracked != nil {
+			tracked.replies = append(tracked.replies, ack.Timestamp)
+		}
+	}
+	bot.trackLock.Unlock()
+	return nil
+}
+
+/*
+If a handler with the HandleEditsInPlace() option is replying to an edited
+message, return the reply to the original message which it should update (and
+keep tracking it). Otherwise, return "".
+*/
+func (bot *Bot) reusableReply(evt *slack.MessageEvent) string {
+	key := messageKey(evt.Msg.Channel, evt.Msg.Timestamp)
+	bot.trackLock.Lock()
+	defer bot.trackLock.Unlock()
+	tracked := bot.tracked[key]
+	if tracked == nil || tracked.reuse == "" {
+		return ""
+	}
+	ts := tracked.reuse
+	tracked.reuse = ""
+	tracked.replies = append(tracked.replies, ts)
+	return ts
+}
+
+/*
+Replace the text of one of the bot's replies. If that fails (say, because
+somebody deleted the reply), send the text as a new message instead.
+*/
+func (bot *Bot) updateReply(channel, ts, msg string) {
+	_, _, _, err := bot.API.UpdateMessage(channel, ts,
+		slack.MsgOptionText(msg, false), slack.MsgOptionAsUser(true))
+	if err != nil {
+		bot.Log.WithFields(logrus.Fields{
+			"channel": channel,
+			"reply":   ts,
+			"error":   err,
+		}).Warn("Couldn't update reply to edited message, sending a new one.")
+		bot.Send(channel, msg)
+	}
+}
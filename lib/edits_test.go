@@ -0,0 +1,61 @@
+package lib
+
+import "testing"
+
+import "github.com/nlopes/slack"
+
+/*
+Return a message_changed event for an edit of message ts in channel C1.
+*/
+func editEvent(ts, edited, oldText, newText string) *slack.MessageEvent {
+	return &slack.MessageEvent{
+		Msg: slack.Msg{Type: "message", SubType: "message_changed", Channel: "C1"},
+		SubMessage: &slack.Msg{
+			Type: "message", User: "U1", Text: newText, Timestamp: ts,
+			Edited: &slack.Edited{User: "U1", Timestamp: edited},
+		},
+		PreviousMessage: &slack.Msg{
+			Type: "message", User: "U1", Text: oldText, Timestamp: ts,
+		},
+	}
+}
+
+func TestEditsInPlace(t *testing.T) {
+	bot, _ := newTestBot()
+	original := &slack.MessageEvent{Msg: slack.Msg{
+		Type: "message", User: "U1", Channel: "C1", Text: "issue a/b typo",
+		Timestamp: "1.000",
+	}}
+	bot.trackMessage(messageKey("C1", "1.000"))
+	bot.trackReply(original, 7)
+	bot.ackHandler(bot, slack.RTMEvent{Type: "ack", Data: &slack.AckMessage{
+		ReplyTo: 7, Timestamp: "2.000",
+	}})
+
+	if bot.unwrapEdit(editEvent("1.000", "3.000", "same", "same"), 1, true) != nil {
+		t.Errorf("an edit which didn't change the text wasn't ignored")
+	}
+	edited := bot.unwrapEdit(editEvent("1.000", "3.000", "issue a/b typo",
+		"issue a/b fixed"), 1, true)
+	if edited == nil {
+		t.Fatal("edit was ignored")
+	}
+	if edited.Msg.Text != "issue a/b fixed" || edited.Msg.Channel != "C1" ||
+		edited.Msg.Timestamp != "1.000" {
+		t.Errorf("edited message is %+v", edited.Msg)
+	}
+	if bot.unwrapEdit(editEvent("1.000", "3.000", "issue a/b typo",
+		"issue a/b fixed"), 1, true) != nil {
+		t.Errorf("the same edit was processed twice")
+	}
+	if ts := bot.reusableReply(edited); ts != "2.000" {
+		t.Errorf("reply to update is %q, expected 2.000", ts)
+	}
+	if ts := bot.reusableReply(edited); ts != "" {
+		t.Errorf("reply %q was updated twice", ts)
+	}
+	tracked := bot.tracked[messageKey("C1", "1.000")]
+	if len(tracked.replies) != 1 || tracked.replies[0] != "2.000" {
+		t.Errorf("tracked replies are %q after updating", tracked.replies)
+	}
+}
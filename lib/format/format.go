@@ -0,0 +1,262 @@
+/*
+Package format builds Slack messages in Slack's "mrkdwn" markup, escaping any
+text which comes from users (or other untrusted places, like API errors) so
+that it can't inject mentions, links or formatting.
+
+Every function here returns a Text, which is markup that is safe to send.
+Functions which take content accept either a Text, which is used as it is, or
+anything else, which is converted to a string (with fmt.Sprint) and escaped.
+So the safe thing happens by default:
+
+    bot.Reply(evt, format.Sprintf("Sorry, I don't know %s.", arg).String())
+    bot.Reply(evt, format.Join(" ", format.Bold("Error:"), err).String())
+
+Here arg and err are escaped, while the Text from Bold() is not.
+
+Escaping only covers &, < and >, which is what it takes to stop mentions and
+links, so escaped text can still be copied and pasted exactly. Formatting
+characters (*, _, ~ and `) in escaped text may still pair up and format it.
+When that matters, use EscapeFormatting().
+*/
+package format
+
+import "fmt"
+import "strings"
+import "time"
+
+/*
+Text is mrkdwn markup which is safe to send to Slack.
+*/
+type Text string
+
+/*
+Return the markup as a string, for bot.Reply() and friends.
+*/
+func (t Text) String() string {
+	return string(t)
+}
+
+const zeroWidthSpace = "\u200b"
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+var formatEscaper = strings.NewReplacer(
+	"&", "&amp;", "<", "&lt;", ">", "&gt;",
+	"*", zeroWidthSpace+"*"+zeroWidthSpace,
+	"_", zeroWidthSpace+"_"+zeroWidthSpace,
+	"~", zeroWidthSpace+"~"+zeroWidthSpace,
+	"`", zeroWidthSpace+"`"+zeroWidthSpace,
+)
+
+/*
+Escape untrusted text, so that it can't contain mentions (like <!here>) or
+links. Everything else is left alone.
+*/
+func Escape(s string) Text {
+	return Text(escaper.Replace(s))
+}
+
+/*
+Escape untrusted text like Escape(), and also stop it from being formatted.
+Slack has no way to escape its formatting characters (*, _, ~ and `), so this
+breaks them up with zero-width spaces, which stops Slack from pairing them up
+while leaving the message looking the same. The catch is that the text can no
+longer be copied exactly, so don't use this for URLs, code or names which the
+reader may want to copy.
+*/
+func EscapeFormatting(s string) Text {
+	return Text(formatEscaper.Replace(s))
+}
+
+/*
+Use markup as it is, without escaping it. Only use this for text which you
+wrote or otherwise trust, like a configured reply.
+*/
+func Raw(s string) Text {
+	return Text(s)
+}
+
+/*
+Convert content to Text, escaping it unless it is Text already.
+*/
+func toText(v interface{}) Text {
+	switch v := v.(type) {
+	case Text:
+		return v
+	case string:
+		return Escape(v)
+	default:
+		return Escape(fmt.Sprint(v))
+	}
+}
+
+/*
+Concatenate content, separated by sep (which is trusted).
+*/
+func Join(sep string, parts ...interface{}) Text {
+	texts := make([]string, len(parts))
+	for i, part := range parts {
+		texts[i] = string(toText(part))
+	}
+	return Text(strings.Join(texts, sep))
+}
+
+/*
+Like fmt.Sprintf, except that every argument which isn't a Text is escaped.
+The format string itself is trusted.
+*/
+func Sprintf(format string, args ...interface{}) Text {
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case Text:
+			escaped[i] = string(arg)
+		case string, error, fmt.Stringer:
+			escaped[i] = string(toText(arg))
+		default:
+			escaped[i] = arg // numbers and the like are safe
+		}
+	}
+	return Text(fmt.Sprintf(format, escaped...))
+}
+
+/*
+Wrap content in a formatting character, which must go right up against the
+text, so it goes outside any leading or trailing whitespace.
+*/
+func wrap(mark string, content []interface{}) Text {
+	s := string(Join("", content...))
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return Text(s)
+	}
+	start := strings.Index(s, trimmed)
+	return Text(s[:start] + mark + trimmed + mark + s[start+len(trimmed):])
+}
+
+/*
+Bold content: *content*
+*/
+func Bold(content ...interface{}) Text {
+	return wrap("*", content)
+}
+
+/*
+Italic content: _content_
+*/
+func Italic(content ...interface{}) Text {
+	return wrap("_", content)
+}
+
+/*
+Struck through content: ~content~
+*/
+func Strike(content ...interface{}) Text {
+	return wrap("~", content)
+}
+
+/*
+Inline code. Formatting doesn't apply inside code, so only &, < and > are
+escaped, and backticks are replaced with a lookalike (since they would end the
+code early).
+*/
+func Code(s string) Text {
+	s = strings.Replace(s, "`", "ˋ", -1)
+	return Text("`" + Escape(s) + "`")
+}
+
+/*
+A block of preformatted code, which may span several lines.
+*/
+func CodeBlock(s string) Text {
+	s = strings.Replace(s, "```", "ˋˋˋ", -1)
+	return Text("```\n" + Escape(s) + "\n```")
+}
+
+/*
+A block quote. Every line of the content is quoted.
+*/
+func Quote(content ...interface{}) Text {
+	lines := strings.Split(string(Join("", content...)), "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return Text(strings.Join(lines, "\n"))
+}
+
+/*
+A bulleted list, one item per line.
+*/
+func List(items ...interface{}) Text {
+	lines := make([]string, len(items))
+	for i, item := range items {
+		lines[i] = "• " + string(toText(item))
+	}
+	return Text(strings.Join(lines, "\n"))
+}
+
+/*
+A numbered list, one item per line, starting from 1.
+*/
+func NumberedList(items ...interface{}) Text {
+	lines := make([]string, len(items))
+	for i, item := range items {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, toText(item))
+	}
+	return Text(strings.Join(lines, "\n"))
+}
+
+/*
+A link to url. If label is empty, Slack shows the URL itself.
+*/
+func Link(url string, label interface{}) Text {
+	url = strings.Replace(string(Escape(url)), "|", "%7C", -1)
+	l := string(toText(label))
+	if l == "" {
+		return Text("<" + url + ">")
+	}
+	return Text("<" + url + "|" + strings.Replace(l, "|", "¦", -1) + ">")
+}
+
+/*
+Mention a user by ID, which notifies them.
+*/
+func User(id string) Text {
+	return Text("<@" + id + ">")
+}
+
+/*
+Refer to a channel by ID, which Slack shows as a link to it.
+*/
+func Channel(id string) Text {
+	return Text("<#" + id + ">")
+}
+
+/*
+Tokens for Date(), which Slack replaces with parts of the date in the time zone
+of whoever is reading the message.
+*/
+const (
+	DateNum         = "{date_num}"          // 2014-02-18
+	DateShort       = "{date_short}"        // Feb 18, 2014
+	DateLong        = "{date_long}"         // Tuesday, February 18th, 2014
+	DatePretty      = "{date_pretty}"       // like {date}, but "today" etc.
+	DateShortPretty = "{date_short_pretty}" // like {date_short}, but "today" etc.
+	DateLongPretty  = "{date_long_pretty}"  // like {date_long}, but "today" etc.
+	Time            = "{time}"              // 6:39 AM or 06:39, per the reader
+	TimeSecs        = "{time_secs}"         // 6:39:42 AM or 06:39:42
+)
+
+/*
+A date, which every reader sees in their own time zone. The format is trusted
+text containing the tokens above, like DateShort + " at " + Time. Clients which
+can't show the date use the fallback instead, or the time in UTC if the fallback
+is empty.
+*/
+func Date(t time.Time, format string, fallback string) Text {
+	if fallback == "" {
+		fallback = t.UTC().Format("Jan 2, 2006 at 3:04 PM UTC")
+	}
+	return Text(fmt.Sprintf("<!date^%d^%s|%s>", t.Unix(), format,
+		strings.Replace(string(Escape(fallback)), "|", "¦", -1)))
+}
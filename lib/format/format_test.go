@@ -0,0 +1,82 @@
+package format
+
+import "errors"
+import "testing"
+import "time"
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, escaped, formatting string
+	}{
+		{"plain text", "plain text", "plain text"},
+		{"a & b", "a &amp; b", "a &amp; b"},
+		{"1 < 2 > 0", "1 &lt; 2 &gt; 0", "1 &lt; 2 &gt; 0"},
+		{"<!here> wake up", "&lt;!here&gt; wake up", "&lt;!here&gt; wake up"},
+		{"hi <@U123|bob>", "hi &lt;@U123|bob&gt;", "hi &lt;@U123|bob&gt;"},
+		{"<!subteam^S1|@oncall>", "&lt;!subteam^S1|@oncall&gt;",
+			"&lt;!subteam^S1|@oncall&gt;"},
+		{"&lt;", "&amp;lt;", "&amp;lt;"},
+		{"*bold*", "*bold*", "\u200b*\u200bbold\u200b*\u200b"},
+		{"snake_case_name", "snake_case_name",
+			"snake\u200b_\u200bcase\u200b_\u200bname"},
+		{"~x~ `y`", "~x~ `y`", "\u200b~\u200bx\u200b~\u200b \u200b`\u200by\u200b`\u200b"},
+		{"https://x.com/a_b*c", "https://x.com/a_b*c",
+			"https://x.com/a\u200b_\u200bb\u200b*\u200bc"},
+	}
+	for _, test := range tests {
+		if got := Escape(test.in); string(got) != test.escaped {
+			t.Errorf("Escape(%q) = %q, expected %q", test.in, got, test.escaped)
+		}
+		if got := EscapeFormatting(test.in); string(got) != test.formatting {
+			t.Errorf("EscapeFormatting(%q) = %q, expected %q", test.in, got,
+				test.formatting)
+		}
+	}
+}
+
+func TestSprintf(t *testing.T) {
+	tests := []struct {
+		got  Text
+		want string
+	}{
+		{Sprintf("Sorry, I don't know %s.", "<!channel>"),
+			"Sorry, I don't know &lt;!channel&gt;."},
+		{Sprintf("%s: %s", Bold("Error"), errors.New("a < b")),
+			"*Error*: a &lt; b"},
+		{Sprintf("%d passes", 3), "3 passes"},
+		{Join(" ", Italic("  hi "), "<@U1>", EscapeFormatting("*")),
+			"  _hi_  &lt;@U1&gt; \u200b*\u200b"},
+	}
+	for _, test := range tests {
+		if string(test.got) != test.want {
+			t.Errorf("got %q, expected %q", test.got, test.want)
+		}
+	}
+}
+
+func TestMarkup(t *testing.T) {
+	tests := []struct {
+		got  Text
+		want string
+	}{
+		{Bold(""), ""},
+		{Strike("x"), "~x~"},
+		{Code("a `b` & c"), "`a ˋbˋ &amp; c`"},
+		{CodeBlock("x := `a`\n```"), "```\nx := `a`\nˋˋˋ\n```"},
+		{Quote("one\ntwo <@U1>"), "> one\n> two &lt;@U1&gt;"},
+		{List("a", Bold("b")), "• a\n• *b*"},
+		{NumberedList("a", "b"), "1. a\n2. b"},
+		{Link("https://x.com/a_b?c=1&d=2|3", "label | <@U1>"),
+			"<https://x.com/a_b?c=1&amp;d=2%7C3|label ¦ &lt;@U1&gt;>"},
+		{Link("https://x.com", ""), "<https://x.com>"},
+		{User("U1"), "<@U1>"},
+		{Channel("C1"), "<#C1>"},
+		{Date(time.Unix(1392734382, 0), DateShort+" at "+Time, "x|y"),
+			"<!date^1392734382^{date_short} at {time}|x¦y>"},
+	}
+	for _, test := range tests {
+		if string(test.got) != test.want {
+			t.Errorf("got %q, expected %q", test.got, test.want)
+		}
+	}
+}
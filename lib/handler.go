@@ -1,5 +1,6 @@
 package lib
 
+import "errors"
 import "regexp"
 
 import "github.com/nlopes/slack"
@@ -41,7 +42,10 @@ CommandHandler is a further specialization of MessageHandler. It receives a
 list of arguments. These arguments have been parsed out of the message, and they
 do not include the part of the message that is addressed to the bot. The syntax
 for argument parsing is similar to Unix shell syntax, as provided by Google's
-shlex package.
+shlex package. Before splitting, Slack's escaping of &, < and > is undone, and
+smart quotes are replaced with plain ones, so 'quoted arguments' work even
+when the user's Slack client curls the quotes. Mentions, channels and links
+are left as they are (like <@U123>), so that they can be looked up.
 
 Similar to how a Unix CLI program would be invoked, args[0] will be the base
 command (the one specified in OnCommand()). args[1] will contain the first
@@ -58,6 +62,44 @@ true inside the handler:
 */
 type CommandHandler func(bot *Bot, msg *slack.MessageEvent, args []string) error
 
+/*
+ReactionHandler handles a reaction being added to or removed from a message. It
+receives the reaction, along with the message it was added to (see Reaction),
+rather than the raw reaction_added or reaction_removed event.
+
+Since the message may have to be fetched with the Web API, the handler runs on
+its own goroutine, like a JobFunc, so it must synchronize access to any plugin
+data it shares with other handlers. A returned error is logged. Returning
+Handled doesn't stop other handlers, since they have already been started.
+
+Register these with bot.OnReaction() or bot.OnReactionRemoved().
+*/
+type ReactionHandler func(bot *Bot, rxn *Reaction) error
+
+/*
+Handled may be returned by any handler to say that it took care of the event,
+so that the handlers after it (those with lower priority) don't see it. It is
+not logged as an error.
+*/
+var Handled = errors.New("handled")
+
+/*
+HandlerOption changes how a handler is registered. Pass options to OnEvent(),
+OnCommand() and the other registration functions.
+*/
+type HandlerOption func(entry *handlerEntry)
+
+/*
+Set the priority of a handler. Handlers with higher priority see each event
+first, so they can stop the rest by returning Handled. The default is 0, unless
+the plugin's config entry sets a different priority for all of its handlers.
+*/
+func Priority(priority int) HandlerOption {
+	return func(entry *handlerEntry) {
+		entry.priority = priority
+	}
+}
+
 /*
 Return a message handler which unconditionally responds with the given message.
 For example, this would cause a bot to reply to questions about who it is:
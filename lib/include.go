@@ -0,0 +1,385 @@
+package lib
+
+/*
+This file implements splitting the bot configuration across several files, with
+the include and pluginsDir settings. See loadConfig() for the merge order.
+*/
+
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "reflect"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+
+import "gopkg.in/yaml.v2"
+
+/*
+Read, substitute and parse a single config file. Errors are prefixed with the
+file name. Relative paths in include and pluginsDir are resolved relative to
+the directory of this file, and each plugin entry records where it came from.
+
+A file may also be a bare YAML list of plugin entries, which is handy for the
+files in pluginsDir.
+*/
+func readConfigFile(filename string) (*botConfig, error) {
+	var config botConfig
+
+	arr, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	arr, err = interpolate(arr)
+	if errs, ok := err.(ConfigErrors); ok {
+		for i := range errs {
+			errs[i] = fmt.Errorf("%s: %s", filename, errs[i])
+		}
+		return nil, errs
+	} else if err != nil {
+		return nil, err
+	}
+
+	var probe interface{}
+	err = yaml.Unmarshal(arr, &probe)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	_, bare := probe.([]interface{})
+	if bare {
+		err = yaml.Unmarshal(arr, &config.Plugins)
+	} else {
+		err = yaml.Unmarshal(arr, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	for i, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			config.Include[i] = filepath.Join(dir, include)
+		}
+	}
+	if config.PluginsDir != "" && !filepath.IsAbs(config.PluginsDir) {
+		config.PluginsDir = filepath.Join(dir, config.PluginsDir)
+	}
+
+	lines := pluginEntryLines(arr, bare)
+	for i := range config.Plugins {
+		config.Plugins[i].file = filename
+		if len(lines) == len(config.Plugins) {
+			config.Plugins[i].line = lines[i]
+			keys := make(map[string][]keyOrigin)
+			for key, line := range pluginKeyLines(arr, lines[i]) {
+				keys[key] = []keyOrigin{{file: filename, line: line}}
+			}
+			config.Plugins[i].keys = keys
+		}
+	}
+	return &config, nil
+}
+
+/*
+Matches the top-level plugins key in a config file.
+*/
+var pluginsKeyRegexp = regexp.MustCompile(`^plugins:\s*(#.*)?$`)
+
+/*
+Return the line number of each item in the plugins list of a config file (or of
+the whole file, if it is a bare list). yaml.v2 doesn't give us line numbers, but
+plugin lists are simple enough that we can find the "- " of each item in the
+text. If the list isn't written in block style, this returns nil.
+*/
+func pluginEntryLines(text []byte, bare bool) []int {
+	var lines []int
+	inList := bare
+	indent := -1
+	for i, line := range strings.Split(string(text), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !inList {
+			inList = pluginsKeyRegexp.MatchString(line)
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if indent < 0 && isItem {
+			indent = lineIndent
+		}
+		if indent < 0 || lineIndent < indent || (lineIndent == indent && !isItem) {
+			break // end of the list
+		}
+		if lineIndent == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+/*
+Matches a key in a plugin entry, after its indentation (and "- ", on the first
+line of the entry).
+*/
+var pluginKeyRegexp = regexp.MustCompile(`^(?:-\s+)?([A-Za-z0-9_]+)\s*:`)
+
+/*
+Return the line number of each key of the plugin entry which starts on a line.
+Keys belong to the entry if they are indented as much as its first key, so this
+stops at the next entry, or at whatever follows the plugins list.
+*/
+func pluginKeyLines(text []byte, start int) map[string]int {
+	keyLines := make(map[string]int)
+	indent := -1
+	lines := strings.Split(string(text), "\n")
+	for i := start - 1; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		if indent < 0 && trimmed == "-" {
+			continue // the first key is on the next line
+		} else if indent < 0 {
+			// the first key comes after the "- " of the list item
+			indent = lineIndent + len(trimmed) -
+				len(strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " "))
+		} else if lineIndent < indent {
+			break
+		} else if lineIndent > indent {
+			continue // inside a value
+		}
+		if match := pluginKeyRegexp.FindStringSubmatch(trimmed); match != nil {
+			keyLines[match[1]] = i + 1
+		}
+	}
+	return keyLines
+}
+
+/*
+Merge the settings of src into dst. Settings which src sets override those of
+dst, and plugin entries from src are added after those of dst.
+*/
+func mergeConfig(dst, src *botConfig) {
+	if src.Token != "" {
+		dst.Token = src.Token
+	}
+	if src.StateFile != "" {
+		dst.StateFile = src.StateFile
+	}
+	if src.SaveDelay != 0 {
+		dst.SaveDelay = src.SaveDelay
+	}
+	if src.PluginsDir != "" {
+		dst.PluginsDir = src.PluginsDir
+	}
+	if src.Prefix != "" {
+		dst.Prefix = src.Prefix
+	}
+	if src.Nicknames != nil {
+		dst.Nicknames = src.Nicknames
+	}
+	if src.Timeout != 0 {
+		dst.Timeout = src.Timeout
+	}
+	for cmd, seconds := range src.Timeouts {
+		if dst.Timeouts == nil {
+			dst.Timeouts = make(map[string]int)
+		}
+		dst.Timeouts[cmd] = seconds
+	}
+	if src.Unknown != "" {
+		dst.Unknown = src.Unknown
+	}
+	for channel, mode := range src.UnknownIn {
+		if dst.UnknownIn == nil {
+			dst.UnknownIn = make(map[string]string)
+		}
+		dst.UnknownIn[channel] = mode
+	}
+	for role, users := range src.Roles {
+		if dst.Roles == nil {
+			dst.Roles = make(map[string][]string)
+		}
+		dst.Roles[role] = users
+	}
+	dst.Plugins = append(dst.Plugins, src.Plugins...)
+}
+
+/*
+Load a config file and, depth first, the files it includes, merging each into
+config. The seen map prevents include cycles.
+*/
+func loadConfigTree(config *botConfig, filename string, seen map[string]bool) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if seen[abs] {
+		return fmt.Errorf("%s: included more than once", filename)
+	}
+	seen[abs] = true
+
+	file, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	mergeConfig(config, file)
+	for _, include := range file.Include {
+		err = loadConfigTree(config, include, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Load the files in a plugins directory (*.yaml and *.yml), in lexical order.
+*/
+func loadPluginsDir(config *botConfig, dir string, seen map[string]bool) error {
+	var names []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		names = append(names, matches...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := loadConfigTree(config, name, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Merge the entries for each plugin into its first entry. Lists (like Respond's
+responses) are concatenated, and other keys may be given by any of the entries,
+but if two entries give different values for a key, that is an error.
+*/
+func mergePlugins(entries []pluginConfigEntry) ([]pluginConfigEntry, error) {
+	var errs ConfigErrors
+	var merged []pluginConfigEntry
+	first := make(map[string]int)
+	for _, entry := range entries {
+		i, ok := first[entry.Name]
+		if !ok {
+			first[entry.Name] = len(merged)
+			merged = append(merged, entry)
+			continue
+		}
+		errs = append(errs, merged[i].merge(&entry)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return merged, nil
+}
+
+/*
+Merge another entry for the same plugin into this one, returning an error for
+each key they conflict on.
+*/
+func (e *pluginConfigEntry) merge(other *pluginConfigEntry) []error {
+	var errs []error
+	conflict := func(key string) {
+		file, line := other.location(key)
+		prevFile, prevLine := e.location(key)
+		errs = append(errs, &PluginConfigError{
+			File: file, Line: line, Plugin: other.Name, Key: key,
+			Err: fmt.Errorf("conflicts with %s", fileLine(prevFile, prevLine)),
+		})
+	}
+	if other.Priority != 0 {
+		if e.Priority != 0 && e.Priority != other.Priority {
+			conflict("priority")
+		} else if e.Priority == 0 {
+			e.Priority = other.Priority
+			e.addOrigins("priority", other, 0)
+		}
+	}
+	for key, value := range other.Config {
+		old, ok := e.Config[key]
+		if !ok {
+			if e.Config == nil {
+				e.Config = make(PluginConfig)
+			}
+			e.Config[key] = value
+			e.addOrigins(key, other, 0)
+			continue
+		}
+		oldList, oldIsList := old.([]interface{})
+		list, isList := value.([]interface{})
+		if oldIsList && isList {
+			e.Config[key] = append(append([]interface{}(nil), oldList...), list...)
+			e.addOrigins(key, other, len(oldList))
+		} else if !reflect.DeepEqual(old, value) {
+			conflict(key)
+		}
+	}
+	return errs
+}
+
+/*
+Record that a key (or, for a list, the elements from offset on) came from
+another entry.
+*/
+func (e *pluginConfigEntry) addOrigins(key string, other *pluginConfigEntry, offset int) {
+	if e.keys == nil {
+		e.keys = make(map[string][]keyOrigin)
+	}
+	for _, origin := range other.keys[key] {
+		origin.offset += offset
+		e.keys[key] = append(e.keys[key], origin)
+	}
+	if len(other.keys[key]) == 0 {
+		e.keys[key] = append(e.keys[key], keyOrigin{
+			file: other.file, line: other.line, offset: offset,
+		})
+	}
+}
+
+/*
+Matches the top-level key of a key path, and the list index after it, if any.
+*/
+var keyPathRegexp = regexp.MustCompile(`^([^.\[]+)(?:\[(\d+)\])?`)
+
+/*
+Return the file and line where a key of a plugin entry was configured. The key
+may be a path like "responses[2].trigger", which is looked up by its top-level
+key and list index. If the key's line isn't known, this returns where the entry
+starts.
+*/
+func (e *pluginConfigEntry) location(key string) (string, int) {
+	file, line := e.file, e.line
+	match := keyPathRegexp.FindStringSubmatch(key)
+	if match == nil {
+		return file, line
+	}
+	index, _ := strconv.Atoi(match[2])
+	for _, origin := range e.keys[match[1]] {
+		if origin.offset <= index {
+			file, line = origin.file, origin.line
+		}
+	}
+	return file, line
+}
+
+/*
+Format a location as "file:line", or just "file" if the line isn't known.
+*/
+func fileLine(file string, line int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return file
+}
@@ -0,0 +1,120 @@
+package lib
+
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "strings"
+
+/*
+Matches a substitution in the config file. "$${" is an escape for a literal
+"${", which is otherwise impossible to write. A substitution can't span lines.
+*/
+var interpolateRegexp = regexp.MustCompile(`\$\$\{|\$\{([^{}\n]*)\}`)
+
+/*
+Substitute environment variables and secret files into the text of a config
+file. This happens before the YAML is parsed, so it works for every setting of
+the bot and of every plugin. The supported forms are:
+
+    ${NAME}              the value of environment variable NAME, which must
+                         be set
+    ${NAME:-default}     the value of NAME, or "default" if NAME is unset or
+                         empty (the default may be empty too)
+    ${file:/path}        the contents of a file, without trailing newlines,
+                         for example a Docker or Kubernetes secret
+    $${                  a literal "${"
+
+Since the substitution is textual, a value containing YAML syntax (like ": " or
+a leading "*") should be quoted in the config file: token: "${SLACK_TOKEN}".
+
+Substitutions in comments are left alone. Every problem is reported, with
+line numbers, rather than just the first.
+*/
+func interpolate(text []byte) ([]byte, error) {
+	var errs ConfigErrors
+	var result bytes.Buffer
+	last := 0
+	for _, match := range interpolateRegexp.FindAllSubmatchIndex(text, -1) {
+		result.Write(text[last:match[0]])
+		last = match[1]
+		lineStart := bytes.LastIndexByte(text[:match[0]], '\n') + 1
+		if inComment(text[lineStart:match[0]]) {
+			result.Write(text[match[0]:match[1]]) // leave comments alone
+			continue
+		}
+		if match[2] < 0 {
+			result.WriteString("${") // the $${ escape
+			continue
+		}
+		expr := string(text[match[2]:match[3]])
+		value, err := interpolateExpr(expr)
+		if err != nil {
+			line := 1 + bytes.Count(text[:match[0]], []byte("\n"))
+			errs = append(errs, fmt.Errorf("line %d: ${%s}: %s", line, expr, err))
+			continue
+		}
+		result.WriteString(value)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	result.Write(text[last:])
+	return result.Bytes(), nil
+}
+
+/*
+Return true if the start of a line has begun a YAML comment: a "#" at the start
+of the line or after whitespace, which isn't inside a quoted string.
+*/
+func inComment(line []byte) bool {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // skip the escaped character
+		case quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++ // '' is an escaped quote
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" \t[{,:", line[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Return the value of a single ${...} expression (without the delimiters).
+*/
+func interpolateExpr(expr string) (string, error) {
+	if strings.HasPrefix(expr, "file:") {
+		contents, err := ioutil.ReadFile(expr[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+	if idx := strings.Index(expr, ":-"); idx >= 0 {
+		value := os.Getenv(expr[:idx])
+		if value == "" {
+			value = expr[idx+2:]
+		}
+		return value, nil
+	}
+	value, ok := os.LookupEnv(expr)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", expr)
+	}
+	return value, nil
+}
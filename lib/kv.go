@@ -0,0 +1,134 @@
+package lib
+
+import "sort"
+import "strings"
+import "time"
+
+import "github.com/sirupsen/logrus"
+
+/*
+KV entries share the bot's state map with whole-plugin state saved through
+UpdateState(). Each entry is stored under the plugin name, this separator, and
+the key. A NUL byte can't appear in a plugin name from the YAML config, so KV
+entries never collide with UpdateState() entries or with another plugin's keys.
+*/
+const kvSeparator = "\x00"
+
+/*
+KV is a namespaced key-value store for plugin state. Unlike GetState() and
+UpdateState(), which encode and save a plugin's entire state at once, a KV store
+encodes and saves each key separately. This is a better fit for plugins which
+hold lots of independent entries, like a karma counter or a list of reminders.
+
+Values are encoded with gob (just like UpdateState), so any gob-encodable value
+may be stored. Changes are persisted through the same state file, and they are
+saved according to the same saveDelay policy as UpdateState().
+
+Get a plugin's KV store with bot.KV(). All KV methods may be called safely from
+any goroutine, and a Get() will always see the result of an earlier Put() or
+Delete().
+*/
+type KV struct {
+	bot    *Bot
+	plugin string
+}
+
+/*
+Return the KV store for a plugin. This is cheap, so there's no need to hang on
+to the result, although you may.
+*/
+func (bot *Bot) KV(plugin string) *KV {
+	return &KV{bot: bot, plugin: plugin}
+}
+
+func (kv *KV) key(key string) string {
+	return kv.plugin + kvSeparator + key
+}
+
+/*
+Return the raw (encoded) bytes stored for a key, and whether it was present.
+*/
+func (kv *KV) GetBytes(key string) ([]byte, bool) {
+	kv.bot.stateLock.RLock()
+	data, ok := kv.bot.state[kv.key(key)]
+	kv.bot.stateLock.RUnlock()
+	return data, ok
+}
+
+/*
+Store raw bytes for a key. The slice should not be modified afterward.
+*/
+func (kv *KV) PutBytes(key string, data []byte) {
+	if data == nil {
+		data = []byte{}
+	}
+	kv.bot.setState(kv.key(key), data)
+}
+
+/*
+Load the value stored for a key into dest, which should be a pointer. Returns
+false if there was no value, or if it could not be decoded into dest (this is
+logged).
+*/
+func (kv *KV) Get(key string, dest interface{}) bool {
+	data, ok := kv.GetBytes(key)
+	if !ok {
+		return false
+	}
+	err := decodeState(data, dest)
+	if err != nil {
+		kv.bot.Log.WithFields(logrus.Fields{
+			"plugin": kv.plugin, "key": key, "error": err,
+		}).Error("Failed to decode KV entry. Continuing.")
+		return false
+	}
+	return true
+}
+
+/*
+Encode value and store it under key. Encoding errors are logged and the existing
+value (if any) is left alone.
+*/
+func (kv *KV) Put(key string, value interface{}) {
+	data, err := encodeState(value)
+	if err != nil {
+		kv.bot.Log.WithFields(logrus.Fields{
+			"plugin": kv.plugin, "key": key, "error": err,
+		}).Error("Failed to encode KV entry. Continuing.")
+		return
+	}
+	kv.PutBytes(key, data)
+}
+
+/*
+Remove a key from the store. Deleting a key which doesn't exist does nothing.
+*/
+func (kv *KV) Delete(key string) {
+	key = kv.key(key)
+	kv.bot.stateLock.Lock()
+	if _, ok := kv.bot.state[key]; ok {
+		delete(kv.bot.state, key)
+		kv.bot.markDirty(time.Duration(kv.bot.stateDelay) * time.Second)
+	}
+	kv.bot.stateLock.Unlock()
+}
+
+/*
+Return a sorted slice of every key in the store which begins with prefix. Use an
+empty prefix to list every key. For example, a reminders plugin might store
+entries under "reminder/USERID/N" and then Scan("reminder/USERID/") to list one
+user's reminders.
+*/
+func (kv *KV) Scan(prefix string) []string {
+	full := kv.key(prefix)
+	keys := make([]string, 0)
+	kv.bot.stateLock.RLock()
+	for key := range kv.bot.state {
+		if strings.HasPrefix(key, full) {
+			keys = append(keys, key[len(kv.plugin)+len(kvSeparator):])
+		}
+	}
+	kv.bot.stateLock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,100 @@
+package lib
+
+import "io/ioutil"
+import "reflect"
+import "testing"
+
+/*
+Create a test bot which won't try to save its state while a test runs.
+*/
+func newStateBot() *Bot {
+	bot := newBot()
+	bot.Log.Out = ioutil.Discard
+	bot.stateDelay = 3600
+	return bot
+}
+
+func TestKV(t *testing.T) {
+	bot := newStateBot()
+	kv := bot.KV("karma")
+	var n int
+	if kv.Get("alice", &n) {
+		t.Errorf("Get() of a missing key succeeded")
+	}
+	kv.Put("alice", 3)
+	if !kv.Get("alice", &n) || n != 3 {
+		t.Errorf("Get() = %d after Put(3)", n)
+	}
+	var s string
+	if kv.Get("alice", &s) {
+		t.Errorf("Get() into the wrong type succeeded")
+	}
+
+	kv.PutBytes("raw", nil)
+	if data, ok := kv.GetBytes("raw"); !ok || len(data) != 0 {
+		t.Errorf("GetBytes() = %v, %v after PutBytes(nil)", data, ok)
+	}
+
+	kv.Delete("alice")
+	if kv.Get("alice", &n) {
+		t.Errorf("Get() succeeded after Delete()")
+	}
+	bot.stateDirty = false
+	kv.Delete("alice")
+	if bot.stateDirty {
+		t.Errorf("deleting a missing key marked the state dirty")
+	}
+}
+
+func TestKVNamespaces(t *testing.T) {
+	bot := newStateBot()
+	karma, other := bot.KV("karma"), bot.KV("karma2")
+	karma.Put("x", 1)
+	other.Put("x", 2)
+	data, _ := encodeState("whole-plugin state")
+	bot.setState("karma", data) // as saved by UpdateState()
+
+	var n int
+	if karma.Get("x", &n); n != 1 {
+		t.Errorf("karma x = %d, expected 1", n)
+	}
+	if other.Get("x", &n); n != 2 {
+		t.Errorf("karma2 x = %d, expected 2", n)
+	}
+	var state string
+	bot.GetState("karma", &state)
+	if state != "whole-plugin state" {
+		t.Errorf("GetState() = %q after using the KV store", state)
+	}
+	other.Delete("x")
+	if !karma.Get("x", &n) {
+		t.Errorf("deleting another plugin's key deleted this one")
+	}
+}
+
+func TestKVScan(t *testing.T) {
+	bot := newStateBot()
+	kv := bot.KV("remind")
+	for _, key := range []string{"reminder/U2/1", "reminder/U1/2", "reminder/U1/1", "other"} {
+		kv.Put(key, true)
+	}
+	bot.KV("remindx").Put("reminder/U1/3", true)
+	bot.KV("rem").Put("indreminder/U1/4", true)
+	data, _ := encodeState(true)
+	bot.setState("remind", data)
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"reminder/U1/", []string{"reminder/U1/1", "reminder/U1/2"}},
+		{"reminder/", []string{"reminder/U1/1", "reminder/U1/2", "reminder/U2/1"}},
+		{"", []string{"other", "reminder/U1/1", "reminder/U1/2", "reminder/U2/1"}},
+		{"nothing", []string{}},
+	}
+	for _, test := range tests {
+		if got := kv.Scan(test.prefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Scan(%q) = %q, expected %q", test.prefix, got, test.want)
+		}
+	}
+}
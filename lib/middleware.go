@@ -0,0 +1,283 @@
+package lib
+
+/*
+This file implements middleware, which wraps message handlers to add behavior
+like access control, rate limiting or logging without modifying the handlers.
+*/
+
+import "fmt"
+import "runtime/debug"
+import "sync"
+import "time"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+Middleware wraps a MessageHandler, returning a new one which does something
+before and/or after calling next, or decides not to call it at all. For
+instance, this would ignore messages from a particular user:
+
+    func ignore(uid string) lib.Middleware {
+        return func(next lib.MessageHandler) lib.MessageHandler {
+            return func(bot *lib.Bot, evt *slack.MessageEvent) error {
+                if evt.Msg.User == uid {
+                    return nil
+                }
+                return next(bot, evt)
+            }
+        }
+    }
+
+Apply middleware to a single handler with Chain() or ChainCommand(), or to
+every handler for messages addressed to the bot with bot.Use().
+*/
+type Middleware func(next MessageHandler) MessageHandler
+
+/*
+Wrap a MessageHandler in middleware. The first middleware is the outermost, so
+it sees each message first:
+
+    bot.OnCommand("deploy", lib.ChainCommand(p.Deploy,
+        lib.RequireRole("admin"), lib.ChannelOnly(), lib.Cooldown(time.Minute)))
+
+*/
+func Chain(mh MessageHandler, mws ...Middleware) MessageHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		mh = mws[i](mh)
+	}
+	return mh
+}
+
+/*
+Same as Chain, but for a CommandHandler. The middleware sees the message, and
+the command handler still receives its arguments.
+*/
+func ChainCommand(ch CommandHandler, mws ...Middleware) CommandHandler {
+	return func(bot *Bot, evt *slack.MessageEvent, args []string) error {
+		return Chain(func(bot *Bot, evt *slack.MessageEvent) error {
+			return ch(bot, evt, args)
+		}, mws...)(bot, evt)
+	}
+}
+
+/*
+Add global middleware, which applies to every handler for messages addressed to
+the bot: those registered with OnAddressed(), OnAddressedMatch(), OnCommand()
+and OnFallback(), whether before or after. It runs after their filtering, so it
+only sees messages which the handler would have received, and it is the
+outermost, so it runs before any middleware the handler was wrapped in with
+Chain(). Call this from a plugin constructor.
+
+Handlers which see every message, from OnMessage() and OnMatch(), don't get
+global middleware. Otherwise, RequireRole() would react to everyone's chatter,
+and a Cooldown() would be used up by messages meant for somebody else. Wrap them
+with Chain() instead.
+*/
+func (bot *Bot) Use(mws ...Middleware) {
+	bot.middleware = append(bot.middleware, mws...)
+}
+
+func (bot *Bot) withMiddleware(mh MessageHandler) MessageHandler {
+	return func(b *Bot, evt *slack.MessageEvent) error {
+		return Chain(mh, bot.middleware...)(b, evt)
+	}
+}
+
+func (bot *Bot) withCommandMiddleware(ch CommandHandler) CommandHandler {
+	return func(b *Bot, evt *slack.MessageEvent, args []string) error {
+		return ChainCommand(ch, bot.middleware...)(b, evt, args)
+	}
+}
+
+/*
+The role which also includes the Slack team's admins and owners.
+*/
+const RoleAdmin = "admin"
+
+/*
+Return true if a user (given their ID) has a role, according to the roles
+section of the config file. Roles list usernames or user IDs. The admin role
+also includes the team's admins and owners. This can be called safely from any
+goroutine.
+*/
+func (bot *Bot) HasRole(uid, role string) bool {
+	user := bot.GetUserByID(uid)
+	if user == nil {
+		return false
+	}
+	if role == RoleAdmin && (user.IsAdmin || user.IsOwner) {
+		return true
+	}
+	return Contains(bot.roles[role], user.Name) || Contains(bot.roles[role], user.ID)
+}
+
+/*
+Give users (by username or ID) a role, in addition to the ones who have it in
+the roles section of the config file. This is for plugins which have their own
+list of trusted users. Call this from a plugin constructor.
+*/
+func (bot *Bot) AddRole(role string, users ...string) {
+	if bot.roles == nil {
+		bot.roles = make(map[string][]string)
+	}
+	bot.roles[role] = append(bot.roles[role], users...)
+}
+
+/*
+Middleware which only lets through messages from users with a role (see
+HasRole). Anybody else gets a :no_entry_sign: reaction.
+*/
+func RequireRole(role string) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			if bot.HasRole(evt.Msg.User, role) {
+				return next(bot, evt)
+			}
+			bot.React(evt, "no_entry_sign")
+			return nil
+		}
+	}
+}
+
+/*
+Middleware which only lets through messages in direct messages with the bot.
+Anywhere else, the user is asked to send a DM instead.
+*/
+func DMOnly() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			if IsDM(evt.Msg.Channel) {
+				return next(bot, evt)
+			}
+			bot.Reply(evt, "Please ask me that in a direct message.")
+			return nil
+		}
+	}
+}
+
+/*
+Middleware which only lets through messages in channels (public or private, or
+group DMs), not direct messages with the bot.
+*/
+func ChannelOnly() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			if !IsDM(evt.Msg.Channel) {
+				return next(bot, evt)
+			}
+			bot.Reply(evt, "Why don't you ask me that in a channel?")
+			return nil
+		}
+	}
+}
+
+/*
+Middleware which lets each user through at most once per period. Messages
+which come too soon get an :hourglass: reaction instead. Each call to Cooldown()
+keeps its own times, so use the same Middleware for handlers which should share
+a cooldown.
+*/
+func Cooldown(period time.Duration) Middleware {
+	var lock sync.Mutex
+	last := make(map[string]time.Time)
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			now := bot.Now()
+			lock.Lock()
+			prev, seen := last[evt.Msg.User]
+			ready := !seen || now.Sub(prev) >= period
+			if ready {
+				last[evt.Msg.User] = now
+			}
+			lock.Unlock()
+			if !ready {
+				bot.React(evt, "hourglass")
+				return nil
+			}
+			return next(bot, evt)
+		}
+	}
+}
+
+/*
+Middleware which recovers from a panic in the handler, logging it with a stack
+trace and returning it as an error, so that one buggy handler can't crash the
+bot.
+*/
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					bot.Log.WithFields(logrus.Fields{
+						"panic":   r,
+						"user":    evt.Msg.User,
+						"channel": evt.Msg.Channel,
+						"text":    evt.Msg.Text,
+						"stack":   string(debug.Stack()),
+					}).Error("Handler panicked.")
+					err = fmt.Errorf("handler panicked: %v", r)
+				}
+			}()
+			return next(bot, evt)
+		}
+	}
+}
+
+/*
+Middleware which logs how long the handler took, and the error it returned (if
+any). The log has the user, channel and text of the message.
+*/
+func Timing() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			start := time.Now()
+			err := next(bot, evt)
+			entry := bot.Log.WithFields(logrus.Fields{
+				"user":     evt.Msg.User,
+				"channel":  evt.Msg.Channel,
+				"text":     evt.Msg.Text,
+				"duration": time.Since(start),
+			})
+			if err != nil && err != Handled {
+				entry.WithField("error", err).Error("Handler failed.")
+			} else {
+				entry.Debug("Handler finished.")
+			}
+			return err
+		}
+	}
+}
+
+/*
+Middleware which returns Handled whenever the handler succeeds, so that handlers
+with lower priority don't see the messages it handled. This suits handlers which
+are already selective, like those registered with OnAddressedMatch().
+*/
+func Exclusive() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			err := next(bot, evt)
+			if err == nil {
+				return Handled
+			}
+			return err
+		}
+	}
+}
+
+/*
+Middleware which holds a lock while the handler runs, for handlers which share
+plugin data with jobs, timers or other goroutines. Pass the same lock to every
+handler which touches the data.
+*/
+func Serialize(lock sync.Locker) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			lock.Lock()
+			defer lock.Unlock()
+			return next(bot, evt)
+		}
+	}
+}
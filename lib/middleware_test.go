@@ -0,0 +1,47 @@
+package lib
+
+import "testing"
+
+import "github.com/nlopes/slack"
+
+func TestUseAppliesToAddressedHandlers(t *testing.T) {
+	bot, _ := newTestBot()
+	var seen []string
+	bot.Use(func(next MessageHandler) MessageHandler {
+		return func(bot *Bot, evt *slack.MessageEvent) error {
+			seen = append(seen, evt.Msg.Text)
+			return next(bot, evt)
+		}
+	})
+	var chatter, addressed, commands int
+	bot.OnMessage("", func(bot *Bot, evt *slack.MessageEvent) error {
+		chatter++
+		return nil
+	})
+	bot.OnMatch("potato", func(bot *Bot, evt *slack.MessageEvent) error {
+		chatter++
+		return nil
+	})
+	bot.OnAddressedMatch("^hello$", func(bot *Bot, evt *slack.MessageEvent) error {
+		addressed++
+		return nil
+	})
+	bot.OnCommand("issue", func(bot *Bot, evt *slack.MessageEvent, args []string) error {
+		commands++
+		return nil
+	})
+
+	sendMessage(bot, "U1", "C1", "who has the potato")
+	if chatter != 2 || len(seen) != 0 {
+		t.Errorf("chatter: %d handler runs, middleware saw %q", chatter, seen)
+	}
+	sendMessage(bot, "U1", "C1", "slacksoc hello")
+	sendMessage(bot, "U1", "C1", "@slacksoc: issue title body")
+	if addressed != 1 || commands != 1 {
+		t.Errorf("%d addressed and %d command handler runs, expected 1 each",
+			addressed, commands)
+	}
+	if len(seen) != 2 || seen[0] != "hello" || seen[1] != "issue title body" {
+		t.Errorf("middleware saw %q", seen)
+	}
+}
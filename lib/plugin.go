@@ -3,6 +3,7 @@ package lib
 import "bytes"
 import "encoding/gob"
 import "fmt"
+import "reflect"
 
 import "github.com/nlopes/slack"
 import "github.com/sirupsen/logrus"
@@ -46,25 +47,26 @@ used either. If you wish to use those, consider registering a handler for the
 
 The API field of the bot is initialized at this point, so constructors may use
 that freely.
-*/
-type PluginConstructor func(bot *Bot, name string, config PluginConfig) Plugin
 
-/*
-pluginStateEvent is used when plugins update their internal state and need to be
-saved. Plugin state is simply bytes (marshalled from their state data
-structures) and it is associated with a name.
+If the plugin can't be constructed (most likely due to bad configuration), the
+constructor should return an error. The bot collects errors from every plugin
+before refusing to start, so it's best to report as many problems as possible
+(see DecodeConfig, ConfigErrors and Bot.ConfigError).
 */
-type pluginStateEvent struct {
-	Type   string
-	Plugin string
-	State  []byte
-}
+type PluginConstructor func(bot *Bot, name string, config PluginConfig) (Plugin, error)
 
 /*
 Internal registry of plugin constructors.
 */
 var plugins = make(map[string]PluginConstructor)
 
+/*
+Internal registries of plugin state types, used to convert the state file to
+and from JSON (see RegisterState).
+*/
+var stateTypes = make(map[string]reflect.Type)
+var kvTypes = make(map[string]reflect.Type)
+
 /*
 This function will register a plugin constructor with the slacksoc library. Your
 name should be unique among all plugins, so one option could be the fully
@@ -74,17 +76,62 @@ func Register(name string, ctor PluginConstructor) {
 	plugins[name] = ctor
 }
 
+/*
+Register the type of a plugin's state, as saved with UpdateState(). The proto
+argument is any value of that type (typically the zero value). This is optional,
+but it allows the "slacksoc state" commands to show and edit the plugin's state
+as JSON. Without it, the state is shown as opaque base64 data. For example:
+
+    lib.RegisterState("MyPlugin", myState{})
+
+Like Register(), this should be called before lib.Run().
+*/
+func RegisterState(name string, proto interface{}) {
+	stateTypes[name] = reflect.TypeOf(proto)
+}
+
+/*
+Same as RegisterState(), but registers the type of the values which a plugin
+stores in its KV store. Every value in the store should have this type.
+*/
+func RegisterKVState(name string, proto interface{}) {
+	kvTypes[name] = reflect.TypeOf(proto)
+}
+
+/*
+Encode a state value into bytes suitable for the state map. All plugin state is
+encoded with gob, so state types must be gob-encodable.
+*/
+func encodeState(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Decode bytes from the state map into dest, the inverse of encodeState().
+*/
+func decodeState(data []byte, dest interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(dest)
+}
+
 /*
 Load the plugin's saved state into dest. Will not do anything if there was no
-saved state.
+saved state. This may be called safely from any goroutine.
 */
 func (bot *Bot) GetState(plugin string, dest interface{}) {
+	bot.stateLock.RLock()
 	state, ok := bot.state[plugin]
+	bot.stateLock.RUnlock()
 	if !ok {
 		return
 	}
-	dec := gob.NewDecoder(bytes.NewReader(state))
-	err := dec.Decode(dest)
+	err := decodeState(state, dest)
 	if err != nil {
 		bot.Log.WithFields(logrus.Fields{
 			"plugin": plugin,
@@ -95,13 +142,14 @@ func (bot *Bot) GetState(plugin string, dest interface{}) {
 /*
 Update your plugin's state. Plugins should call this function whenever their
 persisted state has changed. Their state will be saved to disk based on the bot
-timeout policy.
+timeout policy, or when Flush() is called.
+
+The state is encoded before this returns, so the caller may keep modifying its
+state value afterward. This never blocks waiting on the main bot goroutine, so
+it may be called safely from handlers and from any other goroutine.
 */
 func (bot *Bot) UpdateState(plugin string, state interface{}) {
-	var buf bytes.Buffer
-	var event pluginStateEvent
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(state)
+	data, err := encodeState(state)
 	if err != nil {
 		bot.Log.WithFields(logrus.Fields{
 			"plugin": plugin,
@@ -109,10 +157,10 @@ func (bot *Bot) UpdateState(plugin string, state interface{}) {
 		}).Error("Failed to UpdateState for plugin. Continuing.")
 		return
 	}
-	event.Type = "update"
-	event.Plugin = plugin
-	event.State = buf.Bytes()
-	bot.stateChan <- event
+	bot.Log.WithFields(logrus.Fields{
+		"plugin": plugin,
+	}).Info("Received state update")
+	bot.setState(plugin, data)
 }
 
 /*
@@ -0,0 +1,62 @@
+package lib
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+
+/*
+Plugins may read and update their state from any goroutine, while the state is
+being saved. Run this with -race.
+*/
+func TestConcurrentState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slacksoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bot := newStateBot()
+	bot.stateFile = filepath.Join(dir, "state")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			plugin := fmt.Sprintf("Plugin%d", i)
+			for n := 1; n <= 100; n++ {
+				bot.UpdateState(plugin, n)
+				var got int
+				bot.GetState(plugin, &got)
+				if got != n {
+					t.Errorf("%s: GetState() = %d after UpdateState(%d)", plugin, got, n)
+					return
+				}
+				if n%25 == 0 {
+					bot.Flush()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := bot.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newStateBot()
+	if err := loaded.initLoadState(bot.stateFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		var n int
+		loaded.GetState(fmt.Sprintf("Plugin%d", i), &n)
+		if n != 100 {
+			t.Errorf("Plugin%d saved state %d, expected 100", i, n)
+		}
+	}
+	if bot.Flush() != nil || bot.stateDirty {
+		t.Errorf("Flush() with nothing to save left the state dirty")
+	}
+}
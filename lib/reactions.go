@@ -0,0 +1,213 @@
+package lib
+
+/*
+This file implements handlers for reactions (emoji which users add to messages),
+along with a small cache of the messages that were reacted to, so that handlers
+can see what they are reacting to without each making a Web API call.
+*/
+
+import "errors"
+import "strings"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+How many reacted-to messages the bot remembers.
+*/
+const maxCachedMessages = 200
+
+/*
+Reaction describes a reaction being added to (or removed from) a message, for a
+ReactionHandler. Author and Text describe the message that was reacted to. If
+the bot can't fetch the message (say, because it isn't in the channel), Text is
+empty.
+*/
+type Reaction struct {
+	User      string // ID of the user who reacted
+	Emoji     string // name of the emoji, without colons or skin tone
+	Channel   string // channel of the message
+	Timestamp string // timestamp of the message
+	Author    string // ID of the user who wrote the message
+	Text      string // text of the message
+	Removed   bool   // true if the reaction was removed
+}
+
+/*
+Register a ReactionHandler to be called whenever somebody reacts to a message
+with an emoji. Use an empty emoji ("") to receive every reaction. Skin tones are
+ignored, so "+1" matches "+1::skin-tone-2". For example, this files an issue
+when somebody reacts with :ticket:
+
+    bot.OnReaction("ticket", func(bot *lib.Bot, rxn *lib.Reaction) error {
+        return p.fileIssue(rxn.User, rxn.Text)
+    })
+
+Only reactions to messages are reported, not reactions to files, and the bot's
+own reactions are ignored. Since the message may have to be fetched first, the
+handler runs on its own goroutine (see ReactionHandler).
+*/
+func (bot *Bot) OnReaction(emoji string, rh ReactionHandler, opts ...HandlerOption) {
+	bot.OnEvent("reaction_added", bot.reactionHandler(emoji, rh), opts...)
+}
+
+/*
+Same as OnReaction, but for reactions being removed. Handlers can tell the two
+apart with Reaction.Removed, if they are registered with both.
+*/
+func (bot *Bot) OnReactionRemoved(emoji string, rh ReactionHandler, opts ...HandlerOption) {
+	bot.OnEvent("reaction_removed", bot.reactionHandler(emoji, rh), opts...)
+}
+
+func (bot *Bot) reactionHandler(emoji string, rh ReactionHandler) EventHandler {
+	plugin := bot.configuring
+	return func(b *Bot, evt slack.RTMEvent) error {
+		var rxn Reaction
+		switch e := evt.Data.(type) {
+		case *slack.ReactionAddedEvent:
+			rxn = newReaction(slack.ReactionRemovedEvent(*e))
+		case *slack.ReactionRemovedEvent:
+			rxn = newReaction(*e)
+			rxn.Removed = true
+		default:
+			return nil
+		}
+		if rxn.Channel == "" || rxn.User == bot.User.ID {
+			return nil // a file, or our own reaction
+		}
+		if emoji != "" && rxn.Emoji != emoji {
+			return nil
+		}
+		// fetching the message can take a while, so don't block the main thread
+		go func() {
+			msg, err := bot.GetMessage(rxn.Channel, rxn.Timestamp)
+			if err != nil {
+				bot.Log.WithFields(logrus.Fields{
+					"channel": rxn.Channel,
+					"message": rxn.Timestamp,
+					"error":   err,
+				}).Warn("Couldn't fetch message for reaction.")
+			} else {
+				rxn.Text = msg.Text
+				if rxn.Author == "" {
+					rxn.Author = msg.User
+				}
+			}
+			err = rh(b, &rxn)
+			if err != nil {
+				bot.Log.WithFields(logrus.Fields{
+					"type":   evt.Type,
+					"plugin": plugin,
+					"error":  err,
+				}).Error("Handler failed.")
+			}
+		}()
+		return nil
+	}
+}
+
+func newReaction(e slack.ReactionRemovedEvent) Reaction {
+	emoji := e.Reaction
+	if i := strings.Index(emoji, "::"); i >= 0 {
+		emoji = emoji[:i]
+	}
+	return Reaction{
+		User:      e.User,
+		Emoji:     emoji,
+		Channel:   e.Item.Channel,
+		Timestamp: e.Item.Timestamp,
+		Author:    e.ItemUser,
+	}
+}
+
+/*
+Return a message, given its channel and timestamp. Messages are cached, so this
+only makes a Web API call the first time a message is asked for (or two, for a
+reply in a thread). The message is shared with other callers, so don't modify
+it. This can be called safely from any goroutine, but it may block, so don't
+call it from the main thread.
+*/
+func (bot *Bot) GetMessage(channel, ts string) (*slack.Msg, error) {
+	key := messageKey(channel, ts)
+	bot.msgLock.Lock()
+	msg := bot.msgCache[key]
+	bot.msgLock.Unlock()
+	if msg != nil {
+		return msg, nil
+	}
+
+	msg, err := bot.fetchMessage(channel, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	bot.msgLock.Lock()
+	if bot.msgCache[key] == nil {
+		bot.msgOrder = append(bot.msgOrder, key)
+		if len(bot.msgOrder) > maxCachedMessages {
+			delete(bot.msgCache, bot.msgOrder[0])
+			bot.msgOrder = bot.msgOrder[1:]
+		}
+	}
+	bot.msgCache[key] = msg
+	bot.msgLock.Unlock()
+	return msg, nil
+}
+
+/*
+Fetch a message with the Web API. The channel history only has messages which
+aren't in threads, so if the message isn't there, look for it as a reply.
+*/
+func (bot *Bot) fetchMessage(channel, ts string) (*slack.Msg, error) {
+	history, err := bot.API.GetConversationHistoryContext(bot.ctx,
+		&slack.GetConversationHistoryParameters{
+			ChannelID: channel, Latest: ts, Inclusive: true, Limit: 1,
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(history.Messages) > 0 && history.Messages[0].Timestamp == ts {
+		return &history.Messages[0].Msg, nil
+	}
+
+	replies, _, _, err := bot.API.GetConversationRepliesContext(bot.ctx,
+		&slack.GetConversationRepliesParameters{
+			ChannelID: channel, Timestamp: ts, Latest: ts, Inclusive: true,
+			Limit: 1,
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i := range replies {
+		if replies[i].Timestamp == ts {
+			return &replies[i].Msg, nil
+		}
+	}
+	return nil, errors.New("message not found")
+}
+
+/*
+This handler forgets cached messages when they are edited or deleted, so that
+GetMessage fetches them again.
+*/
+func (bot *Bot) messageCacheHandler(_ *Bot, evt slack.RTMEvent) error {
+	msg, ok := evt.Data.(*slack.MessageEvent)
+	if !ok {
+		return nil
+	}
+	var ts string
+	switch msg.Msg.SubType {
+	case "message_changed":
+		if msg.SubMessage != nil {
+			ts = msg.SubMessage.Timestamp
+		}
+	case "message_deleted":
+		ts = msg.DeletedTimestamp
+	default:
+		return nil
+	}
+	bot.msgLock.Lock()
+	delete(bot.msgCache, messageKey(msg.Msg.Channel, ts))
+	bot.msgLock.Unlock()
+	return nil
+}
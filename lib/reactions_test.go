@@ -0,0 +1,48 @@
+package lib
+
+import "testing"
+import "time"
+
+import "github.com/nlopes/slack"
+
+func TestOnReaction(t *testing.T) {
+	bot, _ := newTestBot()
+	bot.msgCache[messageKey("C1", "1.000")] = &slack.Msg{
+		User: "U2", Text: "the build is broken", Timestamp: "1.000",
+	}
+	reactions := make(chan *Reaction, 10)
+	bot.OnReaction("ticket", func(bot *Bot, rxn *Reaction) error {
+		reactions <- rxn
+		return nil
+	})
+
+	react := func(user, emoji string) {
+		e := &slack.ReactionAddedEvent{
+			Type: "reaction_added", User: user, Reaction: emoji,
+		}
+		e.Item.Type = "message"
+		e.Item.Channel = "C1"
+		e.Item.Timestamp = "1.000"
+		bot.dispatch(slack.RTMEvent{Type: "reaction_added", Data: e},
+			bot.handlers["reaction_added"])
+	}
+	react("U1", "+1")
+	react("U0BOT", "ticket")
+	react("U1", "ticket::skin-tone-2")
+
+	select {
+	case rxn := <-reactions:
+		want := Reaction{User: "U1", Emoji: "ticket", Channel: "C1",
+			Timestamp: "1.000", Author: "U2", Text: "the build is broken"}
+		if *rxn != want {
+			t.Errorf("got reaction %+v, expected %+v", *rxn, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler wasn't called")
+	}
+	select {
+	case rxn := <-reactions:
+		t.Errorf("unexpected reaction %+v", *rxn)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
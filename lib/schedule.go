@@ -0,0 +1,398 @@
+package lib
+
+/*
+This file implements the scheduler, which runs jobs on behalf of plugins: once
+at a particular time (At), at a fixed interval (Every), or on a cron schedule
+(Cron). Jobs don't start until the bot has connected to Slack, so they can
+always use the API and the user and channel info.
+*/
+
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+Timer is a function call scheduled by a Clock. Like time.Timer, Stop() prevents
+the call if it hasn't happened yet, and returns false if it already has.
+*/
+type Timer interface {
+	Stop() bool
+}
+
+/*
+Clock is the scheduler's source of time. The bot normally uses the system clock,
+but a test can substitute a ManualClock (see bot.SetClock) in order to control
+exactly when jobs run.
+*/
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+/*
+ManualClock is a Clock which only moves when it is told to. Timers fire (in
+order) during calls to Advance() or Set(), on the calling goroutine, so a test
+knows that every job which was due has finished running when they return.
+*/
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	when  time.Time
+	seq   int // timers due at the same time fire in the order they were set
+	f     func()
+}
+
+/*
+Create a ManualClock whose time starts at now.
+*/
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	t := &manualTimer{clock: c, when: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Move the clock forward by d, firing any timers which come due along the way.
+*/
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+/*
+Move the clock forward to t, firing any timers which come due along the way.
+Each timer sees Now() as the time it was due. Timers which are set while this
+runs will fire too, if they are due by t. The clock never moves backward.
+*/
+func (c *ManualClock) Set(t time.Time) {
+	for {
+		c.lock.Lock()
+		sort.Slice(c.timers, func(i, j int) bool {
+			a, b := c.timers[i], c.timers[j]
+			if a.when.Equal(b.when) {
+				return a.seq < b.seq
+			}
+			return a.when.Before(b.when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(t) {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.lock.Unlock()
+			return
+		}
+		next := c.timers[0]
+		c.timers = c.timers[1:]
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.lock.Unlock()
+		next.f()
+	}
+}
+
+/*
+Use a different clock for the scheduler, such as a ManualClock in tests. This
+must be called before any jobs are scheduled.
+*/
+func (bot *Bot) SetClock(clock Clock) {
+	bot.clock = clock
+}
+
+/*
+Return the current time according to the bot's clock. Plugins which schedule
+jobs should use this instead of time.Now(), so that they can be tested with a
+ManualClock.
+*/
+func (bot *Bot) Now() time.Time {
+	return bot.clock.Now()
+}
+
+/*
+JobFunc is a function which the scheduler runs. Jobs run on their own
+goroutine, not the main bot goroutine, so they must synchronize access to any
+plugin data they share with event handlers. A returned error is logged.
+*/
+type JobFunc func(bot *Bot) error
+
+/*
+Job is a scheduled job, as returned by At(), Every() and Cron(). Its methods are
+safe to call from any goroutine, including from within the job itself.
+*/
+type Job struct {
+	bot    *Bot
+	plugin string
+	spec   string
+	fn     JobFunc
+	next   func(last time.Time) time.Time // zero when there are no more runs
+
+	lock  sync.Mutex
+	when  time.Time
+	timer Timer
+	done  bool
+}
+
+/*
+Schedule a job to run once, at a particular time. If that time has already
+passed, the job runs as soon as possible. The plugin name is used for logging.
+*/
+func (bot *Bot) At(plugin string, at time.Time, fn JobFunc) *Job {
+	fired := false
+	return bot.addJob(plugin, at.Format(time.RFC3339), fn,
+		func(last time.Time) time.Time {
+			if fired {
+				return time.Time{}
+			}
+			fired = true
+			return at
+		})
+}
+
+/*
+Schedule a job to run repeatedly at a fixed interval, given as a Go duration
+like "30s", "15m" or "1h30m". The first run is one interval after the bot
+connects (or after this is called, if the bot is already connected). If a run
+takes longer than the interval, the runs which were missed are skipped.
+*/
+func (bot *Bot) Every(plugin string, spec string, fn JobFunc) (*Job, error) {
+	interval, err := time.ParseDuration(spec)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval %s is not positive", spec)
+	}
+	return bot.addJob(plugin, spec, fn, func(last time.Time) time.Time {
+		return last.Add(interval)
+	}), nil
+}
+
+/*
+Schedule a job to run on a cron schedule, like "0 9 * * MON-FRI" for 9 AM on
+weekdays. See parseCron() for the syntax. Times are in the local time zone of
+the bot. A spec which can never match, like "0 0 30 2 *", is an error.
+*/
+func (bot *Bot) Cron(plugin string, spec string, fn JobFunc) (*Job, error) {
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return nil, fmt.Errorf("cron spec %q: %s", spec, err)
+	}
+	if schedule.next(bot.Now()).IsZero() {
+		return nil, fmt.Errorf("cron spec %q: never runs", spec)
+	}
+	return bot.addJob(plugin, spec, fn, schedule.next), nil
+}
+
+/*
+Create a job, and start it if the scheduler is running. Otherwise, it waits for
+startScheduler().
+*/
+func (bot *Bot) addJob(plugin, spec string, fn JobFunc, next func(time.Time) time.Time) *Job {
+	job := &Job{bot: bot, plugin: plugin, spec: spec, fn: fn, next: next}
+	bot.schedLock.Lock()
+	started := bot.schedStarted
+	if !started {
+		bot.pendingJobs = append(bot.pendingJobs, job)
+	}
+	bot.schedLock.Unlock()
+	if started {
+		job.start()
+	}
+	return job
+}
+
+/*
+Start every job which was scheduled before the bot connected, along with the
+durable timers saved in the state. This runs on the first hello event, and does
+nothing on later ones (after a reconnect).
+*/
+func startScheduler(bot *Bot, evt slack.RTMEvent) error {
+	bot.schedLock.Lock()
+	if bot.schedStarted {
+		bot.schedLock.Unlock()
+		return nil
+	}
+	bot.schedStarted = true
+	bot.schedStartTime = bot.clock.Now()
+	pending := bot.pendingJobs
+	bot.pendingJobs = nil
+	bot.schedLock.Unlock()
+
+	for _, job := range pending {
+		job.start()
+	}
+	bot.loadTimers()
+	return nil
+}
+
+/*
+Cancel every job which a plugin has scheduled, along with its durable timers,
+and forget its timer handler. This is for a plugin which turned out to be
+broken, before the scheduler starts (see loadPlugin). Its saved timers are left
+in the state, in case it works next time.
+*/
+func (bot *Bot) cancelJobs(plugin string) {
+	var cancelled []*Job
+	bot.schedLock.Lock()
+	kept := bot.pendingJobs[:0]
+	for _, job := range bot.pendingJobs {
+		if job.plugin == plugin {
+			cancelled = append(cancelled, job)
+		} else {
+			kept = append(kept, job)
+		}
+	}
+	bot.pendingJobs = kept
+	for key := range bot.timerJobs {
+		if owner, _, _ := splitStateKey(key); owner == plugin {
+			delete(bot.timerJobs, key)
+		}
+	}
+	delete(bot.timerHandlers, plugin)
+	bot.schedLock.Unlock()
+
+	for _, job := range cancelled {
+		job.Cancel()
+	}
+}
+
+func (job *Job) start() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.done {
+		return
+	}
+	job.arm(job.next(job.bot.clock.Now()))
+}
+
+/*
+Set the timer for the next run, at when (or finish the job if when is zero).
+The caller must hold the job lock.
+*/
+func (job *Job) arm(when time.Time) {
+	job.when = when
+	if when.IsZero() {
+		job.done = true
+		return
+	}
+	clock := job.bot.clock
+	job.timer = clock.AfterFunc(when.Sub(clock.Now()), job.run)
+	job.bot.Log.WithFields(logrus.Fields{
+		"plugin": job.plugin,
+		"job":    job.spec,
+		"next":   when,
+	}).Debug("Scheduled job.")
+}
+
+func (job *Job) run() {
+	job.lock.Lock()
+	if job.done {
+		job.lock.Unlock()
+		return
+	}
+	job.lock.Unlock()
+
+	job.bot.Log.WithFields(logrus.Fields{
+		"plugin": job.plugin,
+		"job":    job.spec,
+	}).Info("Running scheduled job.")
+	err := job.fn(job.bot)
+	if err != nil {
+		job.bot.Log.WithFields(logrus.Fields{
+			"plugin": job.plugin,
+			"job":    job.spec,
+			"error":  err,
+		}).Error("Scheduled job failed.")
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.done {
+		return // cancelled while running
+	}
+	now := job.bot.clock.Now()
+	next := job.next(job.when)
+	for !next.IsZero() && !next.After(now) {
+		next = job.next(next) // skip runs we missed
+	}
+	job.arm(next)
+}
+
+/*
+Cancel the job, so that it never runs again. If it is running right now, that
+run finishes, but no more are scheduled. Cancelling a job more than once is
+harmless.
+*/
+func (job *Job) Cancel() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.done {
+		return
+	}
+	job.done = true
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	job.bot.Log.WithFields(logrus.Fields{
+		"plugin": job.plugin,
+		"job":    job.spec,
+	}).Debug("Cancelled job.")
+}
+
+/*
+Return the time of the job's next run. This is zero if the job is finished or
+cancelled, or if the bot hasn't connected yet.
+*/
+func (job *Job) Next() time.Time {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.done {
+		return time.Time{}
+	}
+	return job.when
+}
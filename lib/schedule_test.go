@@ -0,0 +1,176 @@
+package lib
+
+import "errors"
+import "testing"
+import "time"
+
+import "github.com/nlopes/slack"
+
+/*
+Return a job function which counts its runs.
+*/
+func counter(runs *int) JobFunc {
+	return func(bot *Bot) error {
+		*runs++
+		return nil
+	}
+}
+
+func TestJobsWaitForHello(t *testing.T) {
+	bot, clock := newTestBot()
+	var runs int
+	job := bot.At("test", testStart.Add(time.Minute), counter(&runs))
+	if !job.Next().IsZero() {
+		t.Errorf("job scheduled before hello: %s", job.Next())
+	}
+	clock.Advance(time.Hour)
+	if runs != 0 {
+		t.Fatalf("job ran %d times before hello", runs)
+	}
+
+	// The time has passed, so it runs as soon as the scheduler starts.
+	startScheduler(bot, slack.RTMEvent{})
+	clock.Advance(0)
+	if runs != 1 {
+		t.Errorf("job ran %d times after hello, expected 1", runs)
+	}
+	startScheduler(bot, slack.RTMEvent{}) // a reconnect
+	clock.Advance(time.Hour)
+	if runs != 1 {
+		t.Errorf("job ran %d times after reconnecting, expected 1", runs)
+	}
+}
+
+func TestAt(t *testing.T) {
+	bot, clock := newTestBot()
+	startScheduler(bot, slack.RTMEvent{})
+	var runs int
+	at := testStart.Add(10 * time.Minute)
+	job := bot.At("test", at, counter(&runs))
+	if !job.Next().Equal(at) {
+		t.Errorf("Next() = %s, expected %s", job.Next(), at)
+	}
+	clock.Advance(9 * time.Minute)
+	if runs != 0 {
+		t.Errorf("job ran early")
+	}
+	clock.Advance(time.Minute)
+	if runs != 1 {
+		t.Errorf("job ran %d times, expected 1", runs)
+	}
+	if !job.Next().IsZero() {
+		t.Errorf("finished job has Next() = %s", job.Next())
+	}
+	clock.Advance(time.Hour)
+	if runs != 1 {
+		t.Errorf("job ran %d times, expected 1", runs)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	bot, clock := newTestBot()
+	startScheduler(bot, slack.RTMEvent{})
+	var runs int
+	job, err := bot.Every("test", "15m", counter(&runs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if runs != 4 {
+		t.Errorf("job ran %d times in an hour, expected 4", runs)
+	}
+	if want := clock.Now().Add(15 * time.Minute); !job.Next().Equal(want) {
+		t.Errorf("Next() = %s, expected %s", job.Next(), want)
+	}
+	job.Cancel()
+	job.Cancel()
+	clock.Advance(time.Hour)
+	if runs != 4 {
+		t.Errorf("cancelled job ran")
+	}
+
+	for _, spec := range []string{"soon", "0s", "-1m"} {
+		if _, err := bot.Every("test", spec, counter(&runs)); err == nil {
+			t.Errorf("Every(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestEverySkipsMissedRuns(t *testing.T) {
+	bot, clock := newTestBot()
+	startScheduler(bot, slack.RTMEvent{})
+	var runs int
+	bot.Every("test", "1m", func(bot *Bot) error {
+		runs++
+		clock.Set(bot.Now().Add(150 * time.Second)) // a slow job
+		return nil
+	})
+	clock.Advance(time.Minute)
+	if runs != 1 {
+		t.Errorf("job ran %d times, expected 1", runs)
+	}
+	if now := clock.Now(); !now.Equal(testStart.Add(210 * time.Second)) {
+		t.Errorf("clock at %s after the run", now)
+	}
+}
+
+func TestCron(t *testing.T) {
+	bot, clock := newTestBot()
+	startScheduler(bot, slack.RTMEvent{})
+	var runs int
+	job, err := bot.Cron("test", "0 9 * * MON-FRI", func(bot *Bot) error {
+		runs++
+		if bot.Now().Hour() != 9 {
+			t.Errorf("job ran at %s", bot.Now())
+		}
+		return errors.New("errors are logged, not fatal")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2017, 3, 2, 9, 0, 0, 0, time.UTC); !job.Next().Equal(want) {
+		t.Errorf("Next() = %s, expected %s", job.Next(), want)
+	}
+	clock.Advance(7 * 24 * time.Hour)
+	if runs != 5 {
+		t.Errorf("job ran %d times in a week, expected 5", runs)
+	}
+}
+
+func TestCronErrors(t *testing.T) {
+	bot, _ := newTestBot()
+	for _, spec := range []string{"* * *", "0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		if _, err := bot.Cron("test", spec, nil); err == nil {
+			t.Errorf("Cron(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestBrokenPluginJobsCancelled(t *testing.T) {
+	bot, clock := newTestBot()
+	var runs, fired int
+	ctor := func(bot *Bot, name string, config PluginConfig) (Plugin, error) {
+		bot.At(name, testStart.Add(time.Minute), counter(&runs))
+		bot.Every(name, "1m", counter(&runs))
+		bot.OnTimer(name, func(bot *Bot, timer *DurableTimer) error {
+			fired++
+			return nil
+		})
+		return nil, errors.New("broken")
+	}
+	// A timer saved by a previous run, which would fire when the scheduler starts.
+	record, _ := encodeState(&timerRecord{At: testStart})
+	bot.state["broken"+timerSeparator+"saved"] = record
+
+	bot.collecting = true
+	bot.loadPlugin(ctor, pluginConfigEntry{Name: "broken"})
+	if len(bot.configErrors) != 1 {
+		t.Fatalf("expected 1 config error, got %v", bot.configErrors)
+	}
+
+	startScheduler(bot, slack.RTMEvent{})
+	clock.Advance(time.Hour)
+	if runs != 0 || fired != 0 {
+		t.Errorf("broken plugin ran %d jobs and %d timers", runs, fired)
+	}
+}
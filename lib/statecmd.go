@@ -0,0 +1,312 @@
+package lib
+
+/*
+This file implements the "slacksoc state" subcommands, which let you inspect and
+edit the state file as JSON without writing any Go code. These commands only
+read the config file to find the state file; they never connect to Slack.
+
+Editing the state file while the bot is running is not a good idea: the bot
+will overwrite your changes the next time it saves. Stop the bot first.
+*/
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "reflect"
+import "sort"
+import "strings"
+
+/*
+The JSON representation of one plugin's state. State and KV hold values of the
+types registered with RegisterState() and RegisterKVState(). If no type was
+registered, the gob-encoded bytes are kept as base64 in Raw and RawKV instead,
+so they survive a dump and load unchanged. Timers are the plugin's durable
+timers, whose payloads are always base64.
+*/
+type pluginStateDump struct {
+	State  json.RawMessage            `json:"state,omitempty"`
+	Raw    []byte                     `json:"raw,omitempty"`
+	KV     map[string]json.RawMessage `json:"kv,omitempty"`
+	RawKV  map[string][]byte          `json:"rawKV,omitempty"`
+	Timers map[string]*timerRecord    `json:"timers,omitempty"`
+}
+
+/*
+Split a state map key into its plugin name, the separator (kvSeparator for a KV
+entry, timerSeparator for a durable timer, or "" for the plugin's own state),
+and the KV key or timer ID.
+*/
+func splitStateKey(key string) (plugin string, sep string, subKey string) {
+	idx := strings.IndexAny(key, kvSeparator+timerSeparator)
+	if idx < 0 {
+		return key, "", ""
+	}
+	return key[:idx], key[idx : idx+1], key[idx+1:]
+}
+
+/*
+Decode gob state data of the given type and encode it as JSON.
+*/
+func stateToJSON(data []byte, typ reflect.Type) (json.RawMessage, error) {
+	value := reflect.New(typ)
+	err := decodeState(data, value.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(value.Elem().Interface(), "", "  ")
+}
+
+/*
+The reverse of stateToJSON(): decode JSON into the given type and gob encode it.
+*/
+func stateFromJSON(msg json.RawMessage, typ reflect.Type) ([]byte, error) {
+	value := reflect.New(typ)
+	err := json.Unmarshal(msg, value.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return encodeState(value.Elem().Interface())
+}
+
+/*
+Convert a state map into its JSON representation, optionally only for a single
+plugin.
+*/
+func dumpState(state map[string][]byte, only string) (map[string]*pluginStateDump, error) {
+	dump := make(map[string]*pluginStateDump)
+	for key, data := range state {
+		plugin, sep, subKey := splitStateKey(key)
+		if only != "" && plugin != only {
+			continue
+		}
+		entry, ok := dump[plugin]
+		if !ok {
+			entry = &pluginStateDump{}
+			dump[plugin] = entry
+		}
+
+		if sep == timerSeparator {
+			var record timerRecord
+			err := decodeState(data, &record)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: decoding timer: %s", plugin, err)
+			}
+			if entry.Timers == nil {
+				entry.Timers = make(map[string]*timerRecord)
+			}
+			entry.Timers[subKey] = &record
+			continue
+		}
+		isKV := sep == kvSeparator
+
+		var typ reflect.Type
+		if isKV {
+			typ = kvTypes[plugin]
+		} else {
+			typ = stateTypes[plugin]
+		}
+		if typ == nil {
+			if isKV {
+				if entry.RawKV == nil {
+					entry.RawKV = make(map[string][]byte)
+				}
+				entry.RawKV[subKey] = data
+			} else {
+				entry.Raw = data
+			}
+			continue
+		}
+
+		msg, err := stateToJSON(data, typ)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: decoding state: %s", plugin, err)
+		}
+		if isKV {
+			if entry.KV == nil {
+				entry.KV = make(map[string]json.RawMessage)
+			}
+			entry.KV[subKey] = msg
+		} else {
+			entry.State = msg
+		}
+	}
+	return dump, nil
+}
+
+/*
+Convert one plugin's JSON representation back into state map entries, which
+are added to state.
+*/
+func loadPluginState(state map[string][]byte, plugin string, entry *pluginStateDump) error {
+	if entry.State != nil {
+		typ := stateTypes[plugin]
+		if typ == nil {
+			return fmt.Errorf("plugin %s: no registered state type, use \"raw\"",
+				plugin)
+		}
+		data, err := stateFromJSON(entry.State, typ)
+		if err != nil {
+			return fmt.Errorf("plugin %s: state: %s", plugin, err)
+		}
+		state[plugin] = data
+	} else if entry.Raw != nil {
+		state[plugin] = entry.Raw
+	}
+
+	for key, msg := range entry.KV {
+		typ := kvTypes[plugin]
+		if typ == nil {
+			return fmt.Errorf("plugin %s: no registered KV type, use \"rawKV\"",
+				plugin)
+		}
+		data, err := stateFromJSON(msg, typ)
+		if err != nil {
+			return fmt.Errorf("plugin %s: kv %q: %s", plugin, key, err)
+		}
+		state[plugin+kvSeparator+key] = data
+	}
+	for key, data := range entry.RawKV {
+		state[plugin+kvSeparator+key] = data
+	}
+	for id, record := range entry.Timers {
+		if record == nil {
+			continue
+		}
+		data, err := encodeState(record)
+		if err != nil {
+			return fmt.Errorf("plugin %s: timer %q: %s", plugin, id, err)
+		}
+		state[plugin+timerSeparator+id] = data
+	}
+	return nil
+}
+
+/*
+Delete every entry belonging to a plugin (its state, KV entries and timers)
+from a state map, returning how many were deleted.
+*/
+func clearPluginState(state map[string][]byte, plugin string) int {
+	count := 0
+	for key := range state {
+		owner, _, _ := splitStateKey(key)
+		if owner == plugin {
+			delete(state, key)
+			count++
+		}
+	}
+	return count
+}
+
+/*
+The config file for "slacksoc state clear PLUGIN", when none is given. The other
+state subcommands can't tell a config file from a plugin name or JSON file, so
+they always need one.
+*/
+const defaultConfigFile = "config.yaml"
+
+/*
+Implementation of "slacksoc state". Returns the process exit code.
+*/
+func stateCommand(args []string) int {
+	if len(args) == 2 && args[0] == "clear" {
+		args = []string{"clear", defaultConfigFile, args[1]}
+	}
+	if len(args) < 2 {
+		usage()
+		return 1
+	}
+	config, err := loadConfig(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error loading config:", err)
+		return 1
+	}
+	state, err := readStateFile(config.StateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading state file:", err)
+		return 1
+	}
+
+	switch {
+	case args[0] == "dump" && len(args) <= 3:
+		var only string
+		if len(args) == 3 {
+			only = args[2]
+		}
+		dump, err := dumpState(state, only)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		out, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return 0
+
+	case args[0] == "load" && len(args) <= 3:
+		var input io.Reader = os.Stdin
+		if len(args) == 3 && args[2] != "-" {
+			file, err := os.Open(args[2])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return 1
+			}
+			defer file.Close()
+			input = file
+		}
+		arr, err := ioutil.ReadAll(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		var dump map[string]*pluginStateDump
+		err = json.Unmarshal(arr, &dump)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error parsing JSON:", err)
+			return 1
+		}
+		// Each plugin in the JSON replaces all of that plugin's state, so that
+		// deleting a KV entry from the JSON deletes it from the state file.
+		// Plugins not mentioned in the JSON are left alone.
+		names := make([]string, 0, len(dump))
+		for name := range dump {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			clearPluginState(state, name)
+			if dump[name] == nil {
+				continue
+			}
+			err = loadPluginState(state, name, dump[name])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return 1
+			}
+		}
+		err = writeStateFile(config.StateFile, state)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error writing state file:", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "loaded state for: %s\n", strings.Join(names, ", "))
+		return 0
+
+	case args[0] == "clear" && len(args) == 3:
+		count := clearPluginState(state, args[2])
+		err = writeStateFile(config.StateFile, state)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error writing state file:", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "cleared %d entries for %s\n", count, args[2])
+		return 0
+	}
+
+	usage()
+	return 1
+}
@@ -0,0 +1,138 @@
+package lib
+
+import "bytes"
+import "encoding/json"
+import "reflect"
+import "testing"
+import "time"
+
+type testGame struct {
+	Holder string
+	Passes int
+}
+
+func mustEncode(t *testing.T, value interface{}) []byte {
+	data, err := encodeState(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSplitStateKey(t *testing.T) {
+	tests := []struct{ key, plugin, sep, subKey string }{
+		{"Potato", "Potato", "", ""},
+		{"Karma" + kvSeparator + "alice", "Karma", kvSeparator, "alice"},
+		{"Remind" + timerSeparator + "r1", "Remind", timerSeparator, "r1"},
+		{"Karma" + kvSeparator + "a" + timerSeparator, "Karma", kvSeparator, "a" + timerSeparator},
+	}
+	for _, test := range tests {
+		plugin, sep, subKey := splitStateKey(test.key)
+		if plugin != test.plugin || sep != test.sep || subKey != test.subKey {
+			t.Errorf("splitStateKey(%q) = %q, %q, %q", test.key, plugin, sep, subKey)
+		}
+	}
+}
+
+/*
+Dumping the state to JSON and loading it back must give the same state, for
+typed and untyped state, KV entries and timers alike.
+*/
+func TestStateRoundTrip(t *testing.T) {
+	RegisterState("TestTyped", testGame{})
+	RegisterKVState("TestTyped", 0)
+	defer delete(stateTypes, "TestTyped")
+	defer delete(kvTypes, "TestTyped")
+
+	state := map[string][]byte{
+		"TestTyped":                     mustEncode(t, testGame{"U1", 3}),
+		"TestTyped" + kvSeparator + "a": mustEncode(t, 1),
+		"TestTyped" + kvSeparator + "b": mustEncode(t, 2),
+		"TestRaw":                       mustEncode(t, []string{"opaque"}),
+		"TestRaw" + kvSeparator + "x":   mustEncode(t, "y"),
+		"TestRaw" + timerSeparator + "t": mustEncode(t, &timerRecord{
+			At: time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC), Payload: []byte("p"),
+		}),
+	}
+
+	dump, err := dumpState(state, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dump["TestTyped"].KV["b"]) != "2" {
+		t.Errorf("KV entry dumped as %s, expected 2", dump["TestTyped"].KV["b"])
+	}
+	arr, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded map[string]*pluginStateDump
+	if err := json.Unmarshal(arr, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	restored := make(map[string][]byte)
+	for plugin, entry := range loaded {
+		if err := loadPluginState(restored, plugin, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(restored) != len(state) {
+		t.Errorf("restored %d entries, expected %d", len(restored), len(state))
+	}
+	var game testGame
+	decodeState(restored["TestTyped"], &game)
+	if game != (testGame{"U1", 3}) {
+		t.Errorf("typed state restored as %+v", game)
+	}
+	var n int
+	decodeState(restored["TestTyped"+kvSeparator+"a"], &n)
+	if n != 1 {
+		t.Errorf("typed KV entry restored as %d, expected 1", n)
+	}
+	for _, key := range []string{"TestRaw", "TestRaw" + kvSeparator + "x"} {
+		if !bytes.Equal(restored[key], state[key]) {
+			t.Errorf("raw entry %q changed", key)
+		}
+	}
+	var record timerRecord
+	decodeState(restored["TestRaw"+timerSeparator+"t"], &record)
+	if record.At.Hour() != 9 || string(record.Payload) != "p" {
+		t.Errorf("timer restored as %+v", record)
+	}
+}
+
+func TestDumpOnePlugin(t *testing.T) {
+	state := map[string][]byte{
+		"A": mustEncode(t, 1), "A" + kvSeparator + "k": mustEncode(t, 2),
+		"AB": mustEncode(t, 3),
+	}
+	dump, err := dumpState(state, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump) != 1 || dump["A"] == nil || len(dump["A"].RawKV) != 1 {
+		t.Errorf("dumpState(\"A\") = %v", dump)
+	}
+}
+
+func TestLoadWithoutType(t *testing.T) {
+	entry := &pluginStateDump{State: json.RawMessage(`{"Holder": "U1"}`)}
+	if err := loadPluginState(map[string][]byte{}, "TestUntyped", entry); err == nil {
+		t.Errorf("loading JSON state without a registered type succeeded")
+	}
+}
+
+func TestClearPluginState(t *testing.T) {
+	state := map[string][]byte{
+		"A": nil, "A" + kvSeparator + "k": nil, "A" + timerSeparator + "t": nil,
+		"AB": nil, "B" + kvSeparator + "A": nil,
+	}
+	if count := clearPluginState(state, "A"); count != 3 {
+		t.Errorf("cleared %d entries, expected 3", count)
+	}
+	want := map[string][]byte{"AB": nil, "B" + kvSeparator + "A": nil}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("state after clearing A: %q", state)
+	}
+}
@@ -0,0 +1,271 @@
+package lib
+
+/*
+This file implements parsing of Slack's message text format. Slack sends
+mentions, channel references and links as entities in angle brackets, like
+<@U123|alice> or <http://example.com|a link>, and escapes the characters &, <
+and > everywhere else. See https://api.slack.com/docs/message-formatting
+*/
+
+import "bytes"
+import "fmt"
+import "regexp"
+import "strconv"
+import "strings"
+
+import "github.com/google/shlex"
+
+/*
+The types of entity in the Entity.Type field.
+*/
+const (
+	EntityUser      = "user"      // <@U123> or <@U123|alice>
+	EntityChannel   = "channel"   // <#C123> or <#C123|general>
+	EntityUserGroup = "usergroup" // <!subteam^S123|@oncall>
+	EntitySpecial   = "special"   // <!here>, <!channel>, <!everyone>, <!date^...>
+	EntityLink      = "link"      // <http://example.com> or <mailto:a@b.c|a@b.c>
+)
+
+/*
+Entity is a mention, channel reference or link found in message text. ID is the
+user, channel or user group ID, the URL of a link, or the keyword of a special
+mention ("here", "channel", "everyone" or "date"). Label is the text Slack
+included after the "|", if any. Start and End are the byte offsets of the
+entity in the text, so text[Start:End] is the entity exactly as it was sent.
+*/
+type Entity struct {
+	Type  string
+	ID    string
+	Label string
+	Start int
+	End   int
+}
+
+/*
+ParsedText is message text which has been broken into entities, along with a
+plain text rendering of it, in which entities are replaced by their labels (or
+IDs, if they have no label) and escapes are undone. For a rendering which uses
+the current names of users and channels, use bot.PlainText().
+*/
+type ParsedText struct {
+	Entities []Entity
+	Plain    string
+}
+
+/*
+Parse Slack message text. This never fails: text which isn't a well formed
+entity is treated as plain text.
+*/
+func ParseText(text string) *ParsedText {
+	parsed := &ParsedText{}
+	parsed.Plain = renderText(text, Unescape, func(e *Entity) string {
+		parsed.Entities = append(parsed.Entities, *e)
+		return e.plain()
+	})
+	return parsed
+}
+
+/*
+Render message text as plain text, like ParsedText.Plain, except that users,
+channels and user groups are shown with their current names where the bot
+knows them: "hi <@U123>" becomes "hi @alice". This can be called safely from
+any goroutine.
+*/
+func (bot *Bot) PlainText(text string) string {
+	return renderText(text, Unescape, func(e *Entity) string {
+		switch e.Type {
+		case EntityUser:
+			if user := bot.GetUserByID(e.ID); user != nil {
+				return "@" + user.Name
+			}
+		case EntityChannel:
+			if name := bot.GetChannelByID(e.ID); name != "" {
+				return "#" + name
+			}
+		case EntityUserGroup:
+			if group := bot.GetUserGroup(e.ID); group != nil {
+				return "@" + group.Handle
+			}
+		}
+		return e.plain()
+	})
+}
+
+/*
+Return the IDs of the users mentioned in the text, in order, without repeats.
+*/
+func (p *ParsedText) Users() []string {
+	return p.ids(EntityUser)
+}
+
+/*
+Return the IDs of the channels referenced in the text, in order, without
+repeats.
+*/
+func (p *ParsedText) Channels() []string {
+	return p.ids(EntityChannel)
+}
+
+/*
+Return the IDs of the user groups mentioned in the text, in order, without
+repeats.
+*/
+func (p *ParsedText) UserGroups() []string {
+	return p.ids(EntityUserGroup)
+}
+
+/*
+Return the URLs of the links in the text, in order, without repeats.
+*/
+func (p *ParsedText) Links() []string {
+	return p.ids(EntityLink)
+}
+
+func (p *ParsedText) ids(entityType string) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, e := range p.Entities {
+		if e.Type == entityType && !seen[e.ID] {
+			seen[e.ID] = true
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+/*
+Walk through text, replacing each entity with the result of calling entity, and
+everything in between with the result of calling plain.
+*/
+func renderText(text string, plain func(string) string, entity func(e *Entity) string) string {
+	var out bytes.Buffer
+	rest := 0
+	for rest < len(text) {
+		open := strings.IndexByte(text[rest:], '<')
+		if open < 0 {
+			break
+		}
+		open += rest
+		end := strings.IndexByte(text[open:], '>')
+		if end < 0 {
+			break
+		}
+		end += open + 1
+		out.WriteString(plain(text[rest:open]))
+		e := parseEntity(text[open+1 : end-1])
+		e.Start, e.End = open, end
+		out.WriteString(entity(&e))
+		rest = end
+	}
+	out.WriteString(plain(text[rest:]))
+	return out.String()
+}
+
+/*
+Parse the inside of an entity (between the angle brackets).
+*/
+func parseEntity(inner string) Entity {
+	var e Entity
+	if bar := strings.IndexByte(inner, '|'); bar >= 0 {
+		inner, e.Label = inner[:bar], Unescape(inner[bar+1:])
+	}
+	switch {
+	case strings.HasPrefix(inner, "@"):
+		e.Type, e.ID = EntityUser, inner[1:]
+	case strings.HasPrefix(inner, "#"):
+		e.Type, e.ID = EntityChannel, inner[1:]
+	case strings.HasPrefix(inner, "!subteam^"):
+		e.Type, e.ID = EntityUserGroup, inner[len("!subteam^"):]
+	case strings.HasPrefix(inner, "!"):
+		e.Type, e.ID = EntitySpecial, inner[1:]
+		if caret := strings.IndexByte(e.ID, '^'); caret >= 0 {
+			e.ID = e.ID[:caret] // like <!date^1392734382^{date}|fallback>
+		}
+	default:
+		e.Type, e.ID = EntityLink, Unescape(inner)
+	}
+	return e
+}
+
+/*
+Render an entity as plain text, from what is in the entity itself.
+*/
+func (e *Entity) plain() string {
+	switch e.Type {
+	case EntityUser, EntityUserGroup:
+		if e.Label != "" {
+			return "@" + strings.TrimPrefix(e.Label, "@")
+		}
+		return "@" + e.ID
+	case EntityChannel:
+		if e.Label != "" {
+			return "#" + e.Label
+		}
+		return "#" + e.ID
+	case EntitySpecial:
+		if e.Label != "" {
+			return e.Label
+		}
+		return "@" + e.ID
+	default:
+		if e.Label != "" {
+			return e.Label
+		}
+		return strings.TrimPrefix(e.ID, "mailto:")
+	}
+}
+
+var unescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+/*
+Undo Slack's escaping of &, < and > in message text. Note that entities like
+<@U123> are not escaped, so text with entities in it should go through
+ParseText() instead.
+*/
+func Unescape(s string) string {
+	return unescaper.Replace(s)
+}
+
+var quoteNormalizer = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`,
+	"‘", "'", "’", "'", "‚", "'",
+)
+
+/*
+Replace the "smart" (curly) quotes which Slack clients like to insert with plain
+ASCII quotes.
+*/
+func NormalizeQuotes(s string) string {
+	return quoteNormalizer.Replace(s)
+}
+
+/*
+Split message text into command arguments, like a shell would: unescape it and
+normalize its quotes, but leave entities as they are, so that handlers still
+receive mentions like <@U123> as arguments. An entity is always kept within one
+argument, even if its label has spaces or quotes in it, like
+<https://example.com|two words>.
+*/
+func splitCommand(text string) ([]string, error) {
+	var entities []string
+	replaced := renderText(text, func(s string) string {
+		return NormalizeQuotes(Unescape(s))
+	}, func(e *Entity) string {
+		// a placeholder with nothing in it which shlex would split or unquote
+		entities = append(entities, text[e.Start:e.End])
+		return fmt.Sprintf("\x00%d\x00", len(entities)-1)
+	})
+	args, err := shlex.Split(replaced)
+	if err != nil || len(entities) == 0 {
+		return args, err
+	}
+	for i, arg := range args {
+		args[i] = placeholderRegexp.ReplaceAllStringFunc(arg, func(p string) string {
+			n, _ := strconv.Atoi(p[1 : len(p)-1])
+			return entities[n]
+		})
+	}
+	return args, nil
+}
+
+var placeholderRegexp = regexp.MustCompile("\x00[0-9]+\x00")
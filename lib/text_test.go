@@ -0,0 +1,85 @@
+package lib
+
+import "reflect"
+import "testing"
+
+func TestParseText(t *testing.T) {
+	text := "hi <@U1|alice> and <@U2>, see <#C1|general> or <#C2>. " +
+		"<!subteam^S1|@oncall> <!here> <!date^1392734382^{date}|Feb 18> " +
+		"<https://x.com/?a=1&amp;b=2|a &lt;link&gt;> <mailto:bob@x.com> " +
+		"<@U1> 1 &lt; 2 &amp;&amp; <broken"
+	parsed := ParseText(text)
+	want := []Entity{
+		{Type: EntityUser, ID: "U1", Label: "alice", Start: 3, End: 14},
+		{Type: EntityUser, ID: "U2", Start: 19, End: 24},
+		{Type: EntityChannel, ID: "C1", Label: "general", Start: 30, End: 43},
+		{Type: EntityChannel, ID: "C2", Start: 47, End: 52},
+		{Type: EntityUserGroup, ID: "S1", Label: "@oncall", Start: 54, End: 75},
+		{Type: EntitySpecial, ID: "here", Start: 76, End: 83},
+		{Type: EntitySpecial, ID: "date", Label: "Feb 18", Start: 84, End: 116},
+		{Type: EntityLink, ID: "https://x.com/?a=1&b=2", Label: "a <link>",
+			Start: 117, End: 160},
+		{Type: EntityLink, ID: "mailto:bob@x.com", Start: 161, End: 179},
+		{Type: EntityUser, ID: "U1", Start: 180, End: 185},
+	}
+	if !reflect.DeepEqual(parsed.Entities, want) {
+		t.Errorf("entities:\n%+v\nexpected:\n%+v", parsed.Entities, want)
+	}
+	for i, e := range parsed.Entities {
+		if text[e.Start] != '<' || text[e.End-1] != '>' {
+			t.Errorf("entity %d is %q", i, text[e.Start:e.End])
+		}
+	}
+	plain := "hi @alice and @U2, see #general or #C2. @oncall @here Feb 18 " +
+		"a <link> bob@x.com @U1 1 < 2 && <broken"
+	if parsed.Plain != plain {
+		t.Errorf("plain text is %q, expected %q", parsed.Plain, plain)
+	}
+	if users := parsed.Users(); !reflect.DeepEqual(users, []string{"U1", "U2"}) {
+		t.Errorf("users are %q", users)
+	}
+	if channels := parsed.Channels(); !reflect.DeepEqual(channels, []string{"C1", "C2"}) {
+		t.Errorf("channels are %q", channels)
+	}
+	if groups := parsed.UserGroups(); !reflect.DeepEqual(groups, []string{"S1"}) {
+		t.Errorf("user groups are %q", groups)
+	}
+	links := parsed.Links()
+	if !reflect.DeepEqual(links, []string{"https://x.com/?a=1&b=2", "mailto:bob@x.com"}) {
+		t.Errorf("links are %q", links)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		args []string
+	}{
+		{"issue me a/b title", []string{"issue", "me", "a/b", "title"}},
+		{`love <@U1|alice> <@U2> "thanks &amp; more"`,
+			[]string{"love", "<@U1|alice>", "<@U2>", "thanks & more"}},
+		{"echo “smart quotes” ‘work’", []string{"echo", "smart quotes", "work"}},
+		{"open <https://x.com/a|two words> now",
+			[]string{"open", "<https://x.com/a|two words>", "now"}},
+		{`open <https://x.com/a|it's "quoted">`,
+			[]string{"open", `<https://x.com/a|it's "quoted">`}},
+		{`say "see <https://x.com|the docs> first"`,
+			[]string{"say", "see <https://x.com|the docs> first"}},
+		{"ping <#C1|general> <!subteam^S1|@on call>",
+			[]string{"ping", "<#C1|general>", "<!subteam^S1|@on call>"}},
+		{"a &lt;b&gt; c", []string{"a", "<b>", "c"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		args, err := splitCommand(test.text)
+		if err != nil {
+			t.Errorf("splitCommand(%q): %s", test.text, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitCommand(%q) = %q, expected %q", test.text, args,
+				test.args)
+		}
+	}
+	if _, err := splitCommand(`say "unfinished`); err == nil {
+		t.Errorf("unbalanced quote wasn't an error")
+	}
+}
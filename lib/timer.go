@@ -0,0 +1,240 @@
+package lib
+
+/*
+This file implements durable timers. Unlike jobs from At(), which are forgotten
+when the bot exits, durable timers are saved in the state file, so they still
+fire (late, if need be) after the bot restarts.
+*/
+
+import "bytes"
+import "time"
+
+import "github.com/sirupsen/logrus"
+
+/*
+Durable timers are stored in the bot's state map under the plugin name, this
+separator, and the timer ID, similar to KV entries (see kvSeparator).
+*/
+const timerSeparator = "\x01"
+
+/*
+A durable timer, as it is saved in the state map.
+*/
+type timerRecord struct {
+	At      time.Time `json:"at"`
+	Payload []byte    `json:"payload,omitempty"`
+}
+
+/*
+DurableTimer is a durable timer which has fired, as given to a TimerHandler.
+Late is true if the timer was due before the bot started up, meaning that it
+should have fired while the bot was down.
+*/
+type DurableTimer struct {
+	Plugin  string
+	ID      string
+	At      time.Time
+	Late    bool
+	payload []byte
+}
+
+/*
+Decode the timer's payload into dest, which should be a pointer to a value of
+the same type that was passed to Schedule().
+*/
+func (t *DurableTimer) Payload(dest interface{}) error {
+	return decodeState(t.payload, dest)
+}
+
+/*
+TimerHandler handles a plugin's durable timers when they fire. Like a JobFunc,
+it runs on its own goroutine. Register it with bot.OnTimer().
+*/
+type TimerHandler func(bot *Bot, timer *DurableTimer) error
+
+/*
+Register the function which handles a plugin's durable timers. Each plugin has
+just one, which receives every timer the plugin scheduled, so it should use the
+timer ID or payload to tell them apart. Call this from the plugin constructor,
+so that timers which were saved by a previous run of the bot have somewhere to
+go when it starts.
+*/
+func (bot *Bot) OnTimer(plugin string, th TimerHandler) {
+	bot.schedLock.Lock()
+	bot.timerHandlers[plugin] = th
+	bot.schedLock.Unlock()
+}
+
+/*
+Schedule a durable timer for a plugin. When the time comes, the plugin's
+TimerHandler (see OnTimer) receives the timer ID and payload, which may be any
+gob-encodable value (or nil). The timer is saved with the rest of the plugin
+state, so if the bot is down when it is due, it fires as soon as the bot starts
+up again, with its Late flag set.
+
+Scheduling a timer with the same ID as an existing one replaces it. Timers are
+removed once their handler has run. If the bot stops while a handler is
+running, the timer fires again after the restart, so handlers should be
+prepared for that.
+
+Don't call this from a plugin constructor, since constructors also run when the
+config is only being validated. To set a timer at startup, do it in a "hello"
+event handler.
+*/
+func (bot *Bot) Schedule(plugin, id string, at time.Time, payload interface{}) error {
+	var data []byte
+	if payload != nil {
+		var err error
+		data, err = encodeState(payload)
+		if err != nil {
+			return err
+		}
+	}
+	record := timerRecord{At: at, Payload: data}
+	encoded, err := encodeState(&record)
+	if err != nil {
+		return err
+	}
+	key := plugin + timerSeparator + id
+	bot.stateLock.RLock()
+	unchanged := bytes.Equal(bot.state[key], encoded)
+	bot.stateLock.RUnlock()
+	if !unchanged {
+		bot.setState(key, encoded) // (so re-scheduling doesn't cause a save)
+	}
+	bot.armTimer(plugin, id, record)
+	return nil
+}
+
+/*
+Cancel a durable timer, removing it from the state. Cancelling a timer which
+doesn't exist (or has already fired) is harmless.
+*/
+func (bot *Bot) CancelTimer(plugin, id string) {
+	key := plugin + timerSeparator + id
+	bot.schedLock.Lock()
+	armed := bot.timerJobs[key]
+	delete(bot.timerJobs, key)
+	bot.schedLock.Unlock()
+	if armed != nil && armed.job != nil {
+		armed.job.Cancel()
+	}
+	bot.setState(key, nil)
+}
+
+/*
+A durable timer which has a job waiting to fire it.
+*/
+type armedTimer struct {
+	job *Job
+}
+
+/*
+Create the job which fires a durable timer, replacing any existing job for the
+same timer. The timer is registered in timerJobs before its job exists, since
+the job may fire straight away.
+*/
+func (bot *Bot) armTimer(plugin, id string, record timerRecord) {
+	key := plugin + timerSeparator + id
+	armed := &armedTimer{}
+	bot.schedLock.Lock()
+	old := bot.timerJobs[key]
+	bot.timerJobs[key] = armed
+	bot.schedLock.Unlock()
+	if old != nil && old.job != nil {
+		old.job.Cancel()
+	}
+
+	job := bot.At(plugin, record.At, func(bot *Bot) error {
+		return bot.fireTimer(plugin, id, record, armed)
+	})
+	bot.schedLock.Lock()
+	armed.job = job
+	bot.schedLock.Unlock()
+}
+
+/*
+Run the handler for a durable timer, and then remove the timer, unless the
+handler scheduled a new one with the same ID. A timer which was replaced or
+cancelled in the meantime does nothing.
+*/
+func (bot *Bot) fireTimer(plugin, id string, record timerRecord, armed *armedTimer) error {
+	key := plugin + timerSeparator + id
+	bot.schedLock.Lock()
+	current := bot.timerJobs[key] == armed
+	th := bot.timerHandlers[plugin]
+	late := record.At.Before(bot.schedStartTime)
+	bot.schedLock.Unlock()
+	if !current {
+		return nil
+	}
+
+	var err error
+	if th == nil {
+		bot.Log.WithFields(logrus.Fields{
+			"plugin": plugin,
+			"timer":  id,
+		}).Warn("No handler for durable timer, dropping it.")
+	} else {
+		err = th(bot, &DurableTimer{
+			Plugin: plugin, ID: id, At: record.At, Late: late,
+			payload: record.Payload,
+		})
+	}
+
+	bot.schedLock.Lock()
+	current = bot.timerJobs[key] == armed
+	if current {
+		delete(bot.timerJobs, key)
+	}
+	bot.schedLock.Unlock()
+	if current {
+		bot.setState(key, nil)
+	}
+	return err
+}
+
+/*
+Arm every durable timer in the state which hasn't been armed already. This runs
+when the scheduler starts.
+Timers belonging to plugins which aren't loaded are left alone.
+*/
+func (bot *Bot) loadTimers() {
+	type loaded struct {
+		plugin, id string
+		record     timerRecord
+	}
+	var timers []loaded
+	bot.stateLock.RLock()
+	bot.schedLock.Lock()
+	for key, data := range bot.state {
+		plugin, sep, id := splitStateKey(key)
+		if sep != timerSeparator || bot.timerJobs[key] != nil {
+			continue
+		}
+		if bot.timerHandlers[plugin] == nil {
+			bot.Log.WithFields(logrus.Fields{
+				"plugin": plugin,
+				"timer":  id,
+			}).Warn("Durable timer belongs to a plugin which isn't loaded.")
+			continue
+		}
+		var record timerRecord
+		err := decodeState(data, &record)
+		if err != nil {
+			bot.Log.WithFields(logrus.Fields{
+				"plugin": plugin,
+				"timer":  id,
+				"error":  err,
+			}).Error("Error decoding durable timer.")
+			continue
+		}
+		timers = append(timers, loaded{plugin, id, record})
+	}
+	bot.schedLock.Unlock()
+	bot.stateLock.RUnlock()
+
+	for _, t := range timers {
+		bot.armTimer(t.plugin, t.id, t.record)
+	}
+}
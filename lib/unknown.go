@@ -0,0 +1,144 @@
+package lib
+
+/*
+This file implements the replies to messages which are addressed to the bot but
+which no handler understood, like a mistyped command, with suggestions for the
+commands that the user might have meant.
+*/
+
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+
+import "github.com/nlopes/slack"
+
+import "github.com/brenns10/slacksoc/lib/format"
+
+/*
+The settings for unknownCommands and unknownCommandsIn in the config file.
+*/
+const (
+	unknownOff     = "off"     // say nothing
+	unknownSuggest = "suggest" // reply only if there are similar commands
+	unknownReply   = "reply"   // always reply
+)
+
+/*
+The priority of the unknown command handler, which is the last fallback.
+*/
+const priorityUnknown = math.MinInt32
+
+/*
+The most commands to suggest in a reply.
+*/
+const maxSuggestions = 3
+
+/*
+Return an error if a setting for unknown commands isn't valid.
+*/
+func checkUnknownMode(mode string) error {
+	switch mode {
+	case unknownOff, unknownSuggest, unknownReply:
+		return nil
+	}
+	return fmt.Errorf("%q should be %q, %q or %q", mode, unknownOff,
+		unknownSuggest, unknownReply)
+}
+
+/*
+Set up the unknown command settings from the config file, reporting any which
+aren't valid.
+*/
+func (bot *Bot) configureUnknown(config *botConfig) {
+	if err := checkUnknownMode(config.Unknown); err != nil {
+		bot.ConfigError(&PluginConfigError{Key: "unknownCommands", Err: err})
+	}
+	bot.unknownDefault = config.Unknown
+	bot.unknownModes = make(map[string]string)
+	for channel, mode := range config.UnknownIn {
+		if err := checkUnknownMode(mode); err != nil {
+			bot.ConfigError(&PluginConfigError{
+				Key: "unknownCommandsIn." + channel, Err: err,
+			})
+		}
+		bot.unknownModes[strings.TrimPrefix(channel, "#")] = mode
+	}
+}
+
+/*
+Return the setting for unknown commands in a channel.
+*/
+func (bot *Bot) unknownMode(channel string) string {
+	if mode, ok := bot.unknownModes[channel]; ok {
+		return mode
+	}
+	if mode, ok := bot.unknownModes[bot.GetChannelByID(channel)]; ok {
+		return mode
+	}
+	return bot.unknownDefault
+}
+
+/*
+Return the registered commands which are close to name (by edit distance,
+ignoring case), closest first. A command is close if it is one edit away for
+every three letters of name, so that short words which merely resemble a
+command (like "hello" and "help") don't get a suggestion.
+*/
+func (bot *Bot) suggestCommands(name string) []string {
+	name = strings.ToLower(name)
+	distance := make(map[string]int)
+	var commands []string
+	for key, handlers := range bot.handlers {
+		cmd := strings.TrimPrefix(key, commandKey(""))
+		if cmd == key || len(handlers) == 0 {
+			continue
+		}
+		if d := editDistance(name, strings.ToLower(cmd)); d <= len(name)/3 {
+			distance[cmd] = d
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if distance[commands[i]] != distance[commands[j]] {
+			return distance[commands[i]] < distance[commands[j]]
+		}
+		return commands[i] < commands[j]
+	})
+	if len(commands) > maxSuggestions {
+		commands = commands[:maxSuggestions]
+	}
+	return commands
+}
+
+/*
+This fallback handler replies to addressed messages which no other handler
+claimed, suggesting similar commands. Whether it replies depends on the channel
+(see unknownMode).
+*/
+func unknownCommand(bot *Bot, evt *slack.MessageEvent) error {
+	mode := bot.unknownMode(evt.Msg.Channel)
+	if mode == unknownOff {
+		return nil
+	}
+	args := bot.commandArgs(evt.Msg.Text)
+	if len(args) == 0 {
+		return nil
+	}
+	suggestions := bot.suggestCommands(args[0])
+	if len(suggestions) == 0 && mode != unknownReply {
+		return nil
+	}
+
+	msg := format.Sprintf("I don't know the command %s.", format.Code(args[0]))
+	if len(suggestions) > 0 {
+		codes := make([]interface{}, len(suggestions))
+		for i, cmd := range suggestions {
+			codes[i] = format.Code(cmd)
+		}
+		msg += format.Sprintf(" Did you mean %s?", format.Join(" or ", codes...))
+	}
+	msg += format.Sprintf(" Try %s for a list of plugins.", format.Code("help"))
+	bot.Reply(evt, msg.String())
+	return nil
+}
@@ -0,0 +1,35 @@
+package lib
+
+import "reflect"
+import "testing"
+
+import "github.com/nlopes/slack"
+
+func TestSuggestCommands(t *testing.T) {
+	bot, _ := newTestBot()
+	noop := func(bot *Bot, evt *slack.MessageEvent, args []string) error {
+		return nil
+	}
+	for _, cmd := range []string{"help", "issue", "issues", "standup", "karma"} {
+		bot.OnCommand(cmd, noop)
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"hello", nil},
+		{"hi", nil},
+		{"hlep", nil},
+		{"isue", []string{"issue"}},
+		{"ISSEU", nil},
+		{"issuse", []string{"issue", "issues"}},
+		{"standpu", []string{"standup"}},
+		{"Karma", []string{"karma"}},
+	}
+	for _, test := range tests {
+		if got := bot.suggestCommands(test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("suggestCommands(%q) = %q, expected %q", test.name, got,
+				test.want)
+		}
+	}
+}
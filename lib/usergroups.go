@@ -0,0 +1,191 @@
+package lib
+
+/*
+This file implements the bot's cache of user groups (which Slack's API calls
+"subteams"), like @oncall. These aren't to be confused with private channels,
+which Slack's API calls "groups". User groups aren't part of the RTM connection
+info, so they are fetched with the Web API when the bot connects, and kept up to
+date from RTM events after that.
+*/
+
+import "fmt"
+import "regexp"
+import "sort"
+import "strings"
+
+import "github.com/nlopes/slack"
+import "github.com/sirupsen/logrus"
+
+/*
+Add or replace a user group, unless the cache already has a newer version of it.
+Deleted (disabled) groups are removed. The caller must hold infoLock.
+*/
+func (bot *Bot) putUserGroup(group *slack.UserGroup) {
+	if old, ok := bot.userGroups[group.ID]; ok {
+		if old.DateUpdate > group.DateUpdate {
+			return
+		}
+		if bot.groupByHandle[old.Handle] == old.ID {
+			delete(bot.groupByHandle, old.Handle)
+		}
+		delete(bot.userGroups, old.ID)
+	}
+	if group.DateDelete != 0 {
+		return
+	}
+	bot.userGroups[group.ID] = group
+	bot.groupByHandle[group.Handle] = group.ID
+}
+
+/*
+Fetch every user group and its members, replacing the cache. This makes a Web
+API call, so it runs on its own goroutine (see helloHandler). The bot token
+needs the usergroups:read scope; without it, the cache stays empty.
+*/
+func (bot *Bot) loadUserGroups() {
+	groups, err := bot.API.GetUserGroups(slack.GetUserGroupsOptionIncludeUsers(true))
+	if err != nil {
+		bot.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Couldn't load user groups.")
+		return
+	}
+	bot.infoLock.Lock()
+	old := bot.userGroups
+	bot.userGroups = make(map[string]*slack.UserGroup)
+	bot.groupByHandle = make(map[string]string)
+	for i := range groups {
+		bot.putUserGroup(&groups[i])
+		// keep anything an event updated while we were waiting for the API
+		if group, ok := old[groups[i].ID]; ok {
+			bot.putUserGroup(group)
+		}
+	}
+	bot.infoLock.Unlock()
+	bot.Log.WithFields(logrus.Fields{
+		"count": len(groups),
+	}).Info("Loaded user groups.")
+}
+
+/*
+This handler listens for subteam_created and subteam_updated events, both of
+which carry the whole user group, including its members.
+*/
+func (bot *Bot) userGroupHandler(_ *Bot, evt slack.RTMEvent) error {
+	var group slack.UserGroup
+	switch e := evt.Data.(type) {
+	case *slack.SubteamCreatedEvent:
+		group = e.Subteam
+	case *slack.SubteamUpdatedEvent:
+		group = e.Subteam
+	default:
+		return nil
+	}
+	bot.Log.WithFields(logrus.Fields{
+		"handle": group.Handle, "id": group.ID, "members": len(group.Users),
+	}).Info("handling " + evt.Type + " event")
+	bot.infoLock.Lock()
+	bot.putUserGroup(&group)
+	bot.infoLock.Unlock()
+	return nil
+}
+
+func (bot *Bot) registerUserGroupHandlers() {
+	bot.OnEvent("subteam_created", bot.userGroupHandler)
+	bot.OnEvent("subteam_updated", bot.userGroupHandler)
+}
+
+func copyUserGroup(group *slack.UserGroup) *slack.UserGroup {
+	copied := *group
+	copied.Users = append([]string(nil), group.Users...)
+	return &copied
+}
+
+/*
+Return a copy of the user group with an ID, or nil if there is none. Its Users
+field lists the members' user IDs. This can be called safely from any
+goroutine.
+*/
+func (bot *Bot) GetUserGroup(id string) *slack.UserGroup {
+	bot.infoLock.RLock()
+	defer bot.infoLock.RUnlock()
+	if group, ok := bot.userGroups[id]; ok {
+		return copyUserGroup(group)
+	}
+	return nil
+}
+
+/*
+Return a copy of the user group with a handle (like "oncall", with or without
+the @), or nil if there is none. This can be called safely from any goroutine.
+*/
+func (bot *Bot) GetUserGroupByHandle(handle string) *slack.UserGroup {
+	bot.infoLock.RLock()
+	id := bot.groupByHandle[strings.TrimPrefix(handle, "@")]
+	bot.infoLock.RUnlock()
+	return bot.GetUserGroup(id)
+}
+
+/*
+Return copies of every user group, sorted by handle. This can be called safely
+from any goroutine.
+*/
+func (bot *Bot) GetUserGroups() []*slack.UserGroup {
+	bot.infoLock.RLock()
+	groups := make([]*slack.UserGroup, 0, len(bot.userGroups))
+	for _, group := range bot.userGroups {
+		groups = append(groups, copyUserGroup(group))
+	}
+	bot.infoLock.RUnlock()
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Handle < groups[j].Handle
+	})
+	return groups
+}
+
+/*
+Return the user IDs of a user group's members, given its ID, or nil if the
+group is unknown. The slice may be modified safely. This can be called safely
+from any goroutine.
+*/
+func (bot *Bot) GetGroupMembers(id string) []string {
+	if group := bot.GetUserGroup(id); group != nil {
+		return group.Users
+	}
+	return nil
+}
+
+/*
+Construct a string to @mention a user group, which notifies all its members.
+*/
+func (bot *Bot) MentionGroup(group *slack.UserGroup) string {
+	return fmt.Sprintf("<!subteam^%s|@%s>", group.ID, group.Handle)
+}
+
+/*
+Construct a string to @mention a user group, given its handle (with or without
+the @). If there is no such group, this returns the handle as plain text, like
+"@oncall", which doesn't notify anyone.
+*/
+func (bot *Bot) MentionGroupN(handle string) string {
+	group := bot.GetUserGroupByHandle(handle)
+	if group == nil {
+		return "@" + strings.TrimPrefix(handle, "@")
+	}
+	return bot.MentionGroup(group)
+}
+
+var groupMentionRegexp = regexp.MustCompile(`^<!subteam\^(S\w+)(\|[^>]*)?>$`)
+
+/*
+Given string s, parse a user group mention (<!subteam^S123|@oncall>) and return
+the ID of the group. Like ParseUserMention, this assumes that the mention is the
+entire string. If there is no mention, returns an empty string.
+*/
+func ParseGroupMention(s string) string {
+	match := groupMentionRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
@@ -0,0 +1,83 @@
+package lib
+
+import "reflect"
+import "testing"
+
+import "github.com/nlopes/slack"
+
+/*
+Return a subteam_created or subteam_updated event for a user group.
+*/
+func subteamEvent(type_ string, group slack.UserGroup) slack.RTMEvent {
+	if type_ == "subteam_created" {
+		return slack.RTMEvent{Type: type_, Data: &slack.SubteamCreatedEvent{
+			Type: type_, Subteam: group,
+		}}
+	}
+	return slack.RTMEvent{Type: type_, Data: &slack.SubteamUpdatedEvent{
+		Type: type_, Subteam: group,
+	}}
+}
+
+func TestUserGroupEvents(t *testing.T) {
+	bot, _ := newTestBot()
+	bot.userGroupHandler(bot, subteamEvent("subteam_created", slack.UserGroup{
+		ID: "S1", Handle: "oncall", DateUpdate: 100, Users: []string{"U1"},
+	}))
+	group := bot.GetUserGroupByHandle("@oncall")
+	if group == nil || group.ID != "S1" {
+		t.Fatalf("GetUserGroupByHandle(\"@oncall\") = %v", group)
+	}
+	group.Users[0] = "U9"
+	if members := bot.GetGroupMembers("S1"); !reflect.DeepEqual(members, []string{"U1"}) {
+		t.Errorf("GetGroupMembers() = %q after modifying a copy", members)
+	}
+
+	// A rename, and a new member.
+	bot.userGroupHandler(bot, subteamEvent("subteam_updated", slack.UserGroup{
+		ID: "S1", Handle: "pager", DateUpdate: 200, Users: []string{"U1", "U2"},
+	}))
+	if bot.GetUserGroupByHandle("oncall") != nil {
+		t.Errorf("old handle still finds the group")
+	}
+	if members := bot.GetGroupMembers("S1"); !reflect.DeepEqual(members, []string{"U1", "U2"}) {
+		t.Errorf("GetGroupMembers() = %q after the update", members)
+	}
+	if mention := bot.MentionGroupN("pager"); mention != "<!subteam^S1|@pager>" {
+		t.Errorf("MentionGroupN(\"pager\") = %q", mention)
+	}
+
+	// Events may arrive out of order, so an older version is ignored.
+	bot.userGroupHandler(bot, subteamEvent("subteam_updated", slack.UserGroup{
+		ID: "S1", Handle: "oncall", DateUpdate: 150,
+	}))
+	if group := bot.GetUserGroup("S1"); group.Handle != "pager" {
+		t.Errorf("a stale update renamed the group to %q", group.Handle)
+	}
+
+	// Disabling the group removes it.
+	bot.userGroupHandler(bot, subteamEvent("subteam_updated", slack.UserGroup{
+		ID: "S1", Handle: "pager", DateUpdate: 300, DateDelete: 300,
+	}))
+	if bot.GetUserGroup("S1") != nil || len(bot.GetUserGroups()) != 0 {
+		t.Errorf("disabled group is still cached")
+	}
+	if mention := bot.MentionGroupN("@pager"); mention != "@pager" {
+		t.Errorf("MentionGroupN() of a missing group = %q", mention)
+	}
+}
+
+func TestParseGroupMention(t *testing.T) {
+	tests := map[string]string{
+		"<!subteam^S123|@oncall>": "S123",
+		"<!subteam^S123>":         "S123",
+		"@oncall":                 "",
+		"<@U123>":                 "",
+		"x <!subteam^S123>":       "",
+	}
+	for s, want := range tests {
+		if got := ParseGroupMention(s); got != want {
+			t.Errorf("ParseGroupMention(%q) = %q, expected %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package lib
+
+/*
+This file implements the user directory: indexes of users by email, display
+name and real name, fuzzy search, and ResolveUser(), which turns whatever a user
+typed into a command argument into a user.
+*/
+
+import "fmt"
+import "regexp"
+import "sort"
+import "strings"
+
+import "github.com/nlopes/slack"
+
+/*
+Empty all of the user indexes. The caller must hold infoLock.
+*/
+func (bot *Bot) resetUsers() {
+	bot.userByName = make(map[string]*slack.User)
+	bot.userByID = make(map[string]*slack.User)
+	bot.userByEmail = make(map[string]*slack.User)
+	bot.userByDisplay = make(map[string][]*slack.User)
+	bot.userByReal = make(map[string][]*slack.User)
+}
+
+/*
+Names are compared case-insensitively, so indexes are keyed by this.
+*/
+func userKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func realName(user *slack.User) string {
+	if user.RealName != "" {
+		return user.RealName
+	}
+	return user.Profile.RealName
+}
+
+func removeUser(users []*slack.User, user *slack.User) []*slack.User {
+	for i, other := range users {
+		if other == user {
+			return append(users[:i:i], users[i+1:]...)
+		}
+	}
+	return users
+}
+
+/*
+Add a user to the indexes, replacing any older version of the same user. The
+caller must hold infoLock.
+*/
+func (bot *Bot) putUser(user *slack.User) {
+	if old, ok := bot.userByID[user.ID]; ok {
+		if bot.userByName[old.Name] == old {
+			delete(bot.userByName, old.Name)
+		}
+		if key := userKey(old.Profile.Email); bot.userByEmail[key] == old {
+			delete(bot.userByEmail, key)
+		}
+		key := userKey(old.Profile.DisplayName)
+		bot.userByDisplay[key] = removeUser(bot.userByDisplay[key], old)
+		key = userKey(realName(old))
+		bot.userByReal[key] = removeUser(bot.userByReal[key], old)
+	}
+	bot.userByID[user.ID] = user
+	bot.userByName[user.Name] = user
+	if key := userKey(user.Profile.Email); key != "" {
+		bot.userByEmail[key] = user
+	}
+	if key := userKey(user.Profile.DisplayName); key != "" {
+		bot.userByDisplay[key] = append(bot.userByDisplay[key], user)
+	}
+	if key := userKey(realName(user)); key != "" {
+		bot.userByReal[key] = append(bot.userByReal[key], user)
+	}
+}
+
+/*
+Return the user with an email address (compared case-insensitively), or nil if
+there is none. Users' emails are only visible if the bot has permission to see
+them. This can be called safely from any goroutine.
+*/
+func (bot *Bot) GetUserByEmail(email string) *slack.User {
+	bot.infoLock.RLock()
+	user := bot.userByEmail[userKey(email)]
+	bot.infoLock.RUnlock()
+	return user
+}
+
+/*
+Return the users with a display name (compared case-insensitively). Display
+names aren't unique, so there may be more than one. The slice may be modified
+safely. This can be called safely from any goroutine.
+*/
+func (bot *Bot) GetUsersByDisplayName(name string) []*slack.User {
+	bot.infoLock.RLock()
+	users := append([]*slack.User(nil), bot.userByDisplay[userKey(name)]...)
+	bot.infoLock.RUnlock()
+	return users
+}
+
+/*
+Return the users with a real name (compared case-insensitively). The slice may
+be modified safely. This can be called safely from any goroutine.
+*/
+func (bot *Bot) GetUsersByRealName(name string) []*slack.User {
+	bot.infoLock.RLock()
+	users := append([]*slack.User(nil), bot.userByReal[userKey(name)]...)
+	bot.infoLock.RUnlock()
+	return users
+}
+
+/*
+How well a user matches a search query, lower being better, or -1 for no match.
+Each of the user's names is tried: an exact match is best, then a prefix of the
+name or of a word in it, then a substring, and then a name within a couple of
+typos of the query.
+*/
+func userMatchScore(user *slack.User, query string) int {
+	best := -1
+	names := []string{user.Name, user.Profile.DisplayName, realName(user),
+		user.Profile.Email}
+	for _, name := range names {
+		name = userKey(name)
+		if name == "" {
+			continue
+		}
+		score := -1
+		switch {
+		case name == query:
+			score = 0
+		case strings.HasPrefix(name, query):
+			score = 1
+		case strings.Contains(" "+name, " "+query):
+			score = 2
+		case strings.Contains(name, query):
+			score = 3
+		default:
+			if d := editDistance(name, query); d <= 2 && d < len(query) {
+				score = 3 + d
+			}
+		}
+		if score >= 0 && (best < 0 || score < best) {
+			best = score
+		}
+	}
+	return best
+}
+
+/*
+Search for users whose username, display name, real name or email matches a
+query, case-insensitively and allowing for a typo or two. The best matches come
+first. Deactivated users are left out. This can be called safely from any
+goroutine.
+*/
+func (bot *Bot) FindUsers(query string) []*slack.User {
+	query = userKey(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	if query == "" {
+		return nil
+	}
+	type match struct {
+		user  *slack.User
+		score int
+	}
+	var matches []match
+	bot.infoLock.RLock()
+	for _, user := range bot.userByID {
+		if user.Deleted {
+			continue
+		}
+		if score := userMatchScore(user, query); score >= 0 {
+			matches = append(matches, match{user, score})
+		}
+	}
+	bot.infoLock.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].user.Name < matches[j].user.Name
+	})
+	users := make([]*slack.User, len(matches))
+	for i, m := range matches {
+		users[i] = m.user
+	}
+	return users
+}
+
+var userMentionRegexp = regexp.MustCompile(`^<@([UW]\w+)(\|[^>]*)?>$`)
+var userIDRegexp = regexp.MustCompile(`^[UW][A-Z0-9]{2,}$`)
+
+/*
+Return the user an argument refers to. The argument may be a user mention
+(<@U123>), a user ID, a username (with or without the @), an email address, a
+display name or a real name. Names are compared case-insensitively.
+
+The error describes what went wrong in terms fit for showing to the user: that
+nobody matched (with suggestions from FindUsers, if there are any), that several
+people did, or that the user was deactivated. This can be called safely from
+any goroutine.
+*/
+func (bot *Bot) ResolveUser(arg string) (*slack.User, error) {
+	arg = strings.TrimSpace(arg)
+	if match := userMentionRegexp.FindStringSubmatch(arg); match != nil {
+		user := bot.GetUserByID(match[1])
+		if user == nil {
+			return nil, fmt.Errorf("I don't know the user %s", arg)
+		}
+		return checkDeleted(arg, user)
+	}
+	if userIDRegexp.MatchString(arg) {
+		if user := bot.GetUserByID(arg); user != nil {
+			return checkDeleted(arg, user)
+		}
+	}
+
+	name := strings.TrimPrefix(arg, "@")
+	if strings.Contains(name, "@") {
+		if user := bot.GetUserByEmail(name); user != nil {
+			return checkDeleted(arg, user)
+		}
+	}
+	if user := bot.GetUserByName(strings.ToLower(name)); user != nil {
+		return checkDeleted(arg, user) // (usernames are always lowercase)
+	}
+	for _, users := range [][]*slack.User{
+		bot.GetUsersByDisplayName(name), bot.GetUsersByRealName(name),
+	} {
+		var active []*slack.User
+		for _, user := range users {
+			if !user.Deleted {
+				active = append(active, user)
+			}
+		}
+		if len(active) == 1 {
+			return active[0], nil
+		} else if len(active) > 1 {
+			return nil, fmt.Errorf("%q could be any of %s", arg,
+				userList(active))
+		} else if len(users) > 0 {
+			return checkDeleted(arg, users[0])
+		}
+	}
+
+	suggestions := bot.FindUsers(name)
+	if len(suggestions) > 3 {
+		suggestions = suggestions[:3]
+	}
+	if len(suggestions) > 0 {
+		return nil, fmt.Errorf("I don't know anybody called %q. Did you mean %s?",
+			arg, userList(suggestions))
+	}
+	return nil, fmt.Errorf("I don't know anybody called %q", arg)
+}
+
+func checkDeleted(arg string, user *slack.User) (*slack.User, error) {
+	if user.Deleted {
+		return nil, fmt.Errorf("%s has been deactivated", arg)
+	}
+	return user, nil
+}
+
+/*
+Return a list of users like "@alice, @bob or @carol" for error messages. These
+aren't mentions, so nobody gets notified.
+*/
+func userList(users []*slack.User) string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = "@" + user.Name
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
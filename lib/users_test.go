@@ -0,0 +1,111 @@
+package lib
+
+import "strings"
+import "testing"
+
+import "github.com/nlopes/slack"
+
+func testUser(id, name, display, real, email string) *slack.User {
+	user := &slack.User{ID: id, Name: name, RealName: real}
+	user.Profile.DisplayName = display
+	user.Profile.Email = email
+	return user
+}
+
+/*
+Return a test bot which knows a handful of users, including two Alexes and a
+deactivated user.
+*/
+func newUserBot() *Bot {
+	bot, _ := newTestBot()
+	bot.resetUsers()
+	for _, user := range []*slack.User{
+		testUser("U01", "alice", "Alice", "Alice Liddell", "alice@example.com"),
+		testUser("U02", "bob", "bobby", "Robert Paulson", "Bob@Example.com"),
+		testUser("U03", "alexj", "Alex", "Alex Jones", ""),
+		testUser("U04", "alexk", "Alex", "Alex Kim", ""),
+		testUser("U05", "carol", "Carol", "Carol Danvers", "carol@example.com"),
+	} {
+		bot.putUser(user)
+	}
+	bot.userByID["U05"].Deleted = true
+	return bot
+}
+
+func TestUserIndexes(t *testing.T) {
+	bot := newUserBot()
+	if user := bot.GetUserByEmail("bob@EXAMPLE.com"); user == nil || user.ID != "U02" {
+		t.Errorf("GetUserByEmail() = %v", user)
+	}
+	if users := bot.GetUsersByDisplayName("alex"); len(users) != 2 {
+		t.Errorf("GetUsersByDisplayName(\"alex\") = %d users, expected 2", len(users))
+	}
+	if users := bot.GetUsersByRealName("robert paulson"); len(users) != 1 {
+		t.Errorf("GetUsersByRealName() = %d users, expected 1", len(users))
+	}
+
+	// A profile change must take the user out of the old indexes.
+	bot.putUser(testUser("U02", "rob", "Rob", "Robert Paulson", "rob@example.com"))
+	if user := bot.GetUserByEmail("bob@example.com"); user != nil {
+		t.Errorf("old email still finds %s", user.Name)
+	}
+	if users := bot.GetUsersByDisplayName("bobby"); len(users) != 0 {
+		t.Errorf("old display name still finds %d users", len(users))
+	}
+	if users := bot.GetUsersByRealName("Robert Paulson"); len(users) != 1 {
+		t.Errorf("real name finds %d users after an update, expected 1", len(users))
+	}
+	if bot.GetUserByName("bob") != nil || bot.GetUserByName("rob") == nil {
+		t.Errorf("username index wasn't updated")
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	bot := newUserBot()
+	tests := []struct{ arg, id string }{
+		{"<@U01>", "U01"},
+		{"<@U01|alice>", "U01"},
+		{"U02", "U02"},
+		{"alice", "U01"},
+		{"@Alice", "U01"},
+		{"alice@example.com", "U01"},
+		{"bobby", "U02"},
+		{"Robert Paulson", "U02"},
+		{"Alex Kim", "U04"},
+	}
+	for _, test := range tests {
+		user, err := bot.ResolveUser(test.arg)
+		if err != nil {
+			t.Errorf("ResolveUser(%q): %s", test.arg, err)
+		} else if user.ID != test.id {
+			t.Errorf("ResolveUser(%q) = %s, expected %s", test.arg, user.ID, test.id)
+		}
+	}
+
+	errors := []struct{ arg, want string }{
+		{"alex", "could be any of @alexj or @alexk"},
+		{"carol", "deactivated"},
+		{"<@U09>", "don't know the user"},
+		{"alcie", "Did you mean @alice?"},
+		{"zed", "don't know anybody called \"zed\""},
+	}
+	for _, test := range errors {
+		user, err := bot.ResolveUser(test.arg)
+		if err == nil {
+			t.Errorf("ResolveUser(%q) = %s, expected an error", test.arg, user.ID)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ResolveUser(%q) error %q, expected %q", test.arg, err, test.want)
+		}
+	}
+}
+
+func TestFindUsers(t *testing.T) {
+	bot := newUserBot()
+	users := bot.FindUsers("al")
+	if len(users) != 3 || users[0].Name != "alexj" {
+		t.Errorf("FindUsers(\"al\") = %s", userList(users))
+	}
+	if users := bot.FindUsers("carol"); len(users) != 0 {
+		t.Errorf("FindUsers() found a deactivated user")
+	}
+}
@@ -12,7 +12,13 @@ A helper method which will reply to a message event with a message. This doesn't
 block the main thread.
 */
 func (bot *Bot) Reply(evt *slack.MessageEvent, msg string) {
-	bot.RTM.SendMessage(bot.RTM.NewOutgoingMessage(msg, evt.Msg.Channel))
+	if ts := bot.reusableReply(evt); ts != "" {
+		go bot.updateReply(evt.Msg.Channel, ts, msg) // see HandleEditsInPlace
+		return
+	}
+	out := bot.RTM.NewOutgoingMessage(msg, evt.Msg.Channel)
+	bot.trackReply(evt, out.ID)
+	bot.RTM.SendMessage(out)
 }
 
 /*
@@ -77,6 +83,7 @@ func (bot *Bot) MentionI(id string) string {
 
 /*
 Construct a string for a special mention - @channel, @here, @group, @everyone.
+To mention a user group like @oncall, use MentionGroup().
 */
 func (bot *Bot) SpecialMention(target string) string {
 	return fmt.Sprintf("<!%s>", target)
@@ -126,6 +133,7 @@ func IsUser(id string) bool {
 Given string s, parse a user mention and return the user ID associated with it.
 This assumes that the user mention is the entire string. If there is no mention,
 returns an empty string.
+To find every mention in some text, use ParseText().
 */
 func ParseUserMention(s string) string {
 	expr := regexp.MustCompile(`<@(U\w+)(\|\w+)?>`)
@@ -138,3 +146,38 @@ func ParseUserMention(s string) string {
 	}
 	return s[match[2]:match[3]]
 }
+
+/*
+Return the edit (Levenshtein) distance between two strings: the number of runes
+which must be inserted, deleted or replaced to turn one into the other.
+*/
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,39 @@
+package lib
+
+import "fmt"
+import "io/ioutil"
+import "os"
+
+import "github.com/sirupsen/logrus"
+
+/*
+Implementation of "slacksoc validate CONFIG". This loads the config file and
+constructs every plugin, exactly as the bot would at startup, but it never
+connects to Slack. Every configuration error from every plugin is printed, and
+the return value (the process exit code) is nonzero if there were any.
+*/
+func validateCommand(args []string) int {
+	if len(args) != 1 {
+		usage()
+		return 1
+	}
+	bot := newBot()
+	bot.Log.Out = ioutil.Discard // plugin logging is just noise here
+	bot.Log.Level = logrus.ErrorLevel
+	bot.validating = true
+
+	err := bot.configure(args[0])
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d configuration error(s)\n", args[0],
+			len(errs))
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: OK (%d plugins)\n", args[0], len(bot.plugins))
+	return 0
+}
@@ -4,10 +4,11 @@ import "fmt"
 import "strconv"
 
 import "github.com/brenns10/slacksoc/lib"
+import "github.com/brenns10/slacksoc/lib/format"
 import "github.com/nlopes/slack"
 
 type debugConfig struct {
-	Trusted []string
+	Trusted []string `required:"true" example:"[\"brenns10\"]" desc:"Usernames which are trusted to use the debug commands. They are given the debug role, which the roles section can give to others too."`
 }
 
 type debugState struct {
@@ -20,25 +21,10 @@ type debug struct {
 	State  debugState
 }
 
-func (d *debug) trustedCommand(ch lib.CommandHandler) lib.CommandHandler {
-	return func(bot *lib.Bot, event *slack.MessageEvent, args []string) error {
-		if lib.Contains(d.Config.Trusted, bot.GetUserByID(event.User).Name) {
-			return ch(bot, event, args)
-		}
-		bot.React(event, "no_entry_sign")
-		return nil
-	}
-}
-
-func (d *debug) trustedHandler(mh lib.MessageHandler) lib.MessageHandler {
-	return func(bot *lib.Bot, event *slack.MessageEvent) error {
-		if lib.Contains(d.Config.Trusted, bot.GetUserByID(event.User).Name) {
-			return mh(bot, event)
-		}
-		bot.React(event, "no_entry_sign")
-		return nil
-	}
-}
+/*
+The role which may use the debug commands. The trusted users have it.
+*/
+const debugRole = "debug"
 
 func (d *debug) Users(bot *lib.Bot, event *slack.MessageEvent) error {
 	users := bot.GetUsers()
@@ -51,8 +37,8 @@ func (d *debug) Users(bot *lib.Bot, event *slack.MessageEvent) error {
 
 func (d *debug) Channels(bot *lib.Bot, event *slack.MessageEvent) error {
 	for _, channel := range bot.GetChannels() {
-		bot.Reply(event, fmt.Sprintf("channel: id=%s, name=%s", channel.ID,
-			channel.Name))
+		bot.Reply(event, fmt.Sprintf("channel: id=%s, name=%s, type=%s",
+			channel.ID, channel.Name, channel.Type))
 	}
 	return nil
 }
@@ -66,7 +52,7 @@ func (d *debug) Metadata(bot *lib.Bot, event *slack.MessageEvent) error {
 }
 
 func (d *debug) Info(bot *lib.Bot, event *slack.MessageEvent) error {
-	bot.Reply(event, bot.MentionI(event.Msg.User)+": we are in "+
+	bot.Reply(event, format.User(event.Msg.User).String()+": we are in "+
 		bot.SayChannelI(event.Msg.Channel)+", tell "+
 		bot.SpecialMention("everyone"))
 	return nil
@@ -125,18 +111,23 @@ func (d *debug) Help() string {
 /*
 Create a new debug plugin.
 */
-func newDebug(bot *lib.Bot, name string, cfg lib.PluginConfig) lib.Plugin {
+func newDebug(bot *lib.Bot, name string, cfg lib.PluginConfig) (lib.Plugin, error) {
 	d := &debug{}
 	d.name = name
-	bot.Configure(cfg, &d.Config, []string{"Trusted"})
+	err := bot.DecodeConfig(cfg, &d.Config, nil)
+	if err != nil {
+		return nil, err
+	}
 	bot.GetState(name, &d.State)
-	bot.OnAddressedMatch("^users$", d.trustedHandler(d.Users))
-	bot.OnAddressedMatch("^channels$", d.trustedHandler(d.Channels))
-	bot.OnAddressedMatch("^metadata$", d.trustedHandler(d.Metadata))
-	bot.OnAddressedMatch("^info$", d.trustedHandler(d.Info))
+	bot.AddRole(debugRole, d.Config.Trusted...)
+	trusted := lib.RequireRole(debugRole)
+	bot.OnAddressedMatch("^users$", lib.Chain(d.Users, trusted))
+	bot.OnAddressedMatch("^channels$", lib.Chain(d.Channels, trusted))
+	bot.OnAddressedMatch("^metadata$", lib.Chain(d.Metadata, trusted))
+	bot.OnAddressedMatch("^info$", lib.Chain(d.Info, trusted))
 	bot.OnAddressedMatch("^version$", lib.Reply("My version is 1.2.2"))
 	bot.OnCommand("id", d.Id)
 	bot.OnCommand("state", d.StateCmd)
 	bot.OnAddressedMatch("^pm me$", d.PM)
-	return d
+	return d, nil
 }
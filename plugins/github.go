@@ -10,11 +10,12 @@ github.com/ajm188/slack
 
 import (
 	"context"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/brenns10/slacksoc/lib"
+	"github.com/brenns10/slacksoc/lib/format"
 	"github.com/google/go-github/github"
 	"github.com/nlopes/slack"
 	"github.com/sirupsen/logrus"
@@ -27,36 +28,25 @@ Contains the OAuth "stuff" necessary to connect, and a client to actually
 perform operations.
 */
 type ghPlugin struct {
-	ClientID     string
-	ClientSecret string
-	AccessToken  string
+	ClientID     string `required:"true" example:"\"${GITHUB_CLIENT_ID}\"" desc:"clientID and clientSecret should be created by registering an app: https://github.com/settings/applications/new"`
+	ClientSecret string `required:"true" example:"\"${GITHUB_CLIENT_SECRET}\""`
+	AccessToken  string `required:"true" example:"\"${GITHUB_ACCESS_TOKEN}\"" desc:"accessToken is the authorization for your application to act on behalf of a particular user. Log into this user on GitHub and go here:\n\nhttps://github.com/login/oauth/authorize?scope=repo&client_id=$CLIENT_ID\n\nThen, take the code appended to the URL and POST it to https://github.com/login/oauth/access_token with your client_id, client_secret and code. The accessToken will be in the response."`
 	client       *github.Client
-}
-
-func (g *ghPlugin) secretsMissing() bool {
-	return g.ClientID == "" || g.ClientSecret == "" || g.AccessToken == ""
-}
 
-func (g *ghPlugin) fromEnvVar() {
-	g.ClientID = os.Getenv("GITHUB_CLIENT_ID")
-	g.ClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
-	g.AccessToken = os.Getenv("GITHUB_ACCESS_TOKEN")
+	lock       sync.Mutex
+	issues     map[string]*filedIssue // by channel and message timestamp
+	issueOrder []string               // keys of issues, oldest first
 }
 
-func newGitHub(bot *lib.Bot, _ string, cfg lib.PluginConfig) lib.Plugin {
-	g := ghPlugin{}
-	bot.Configure(cfg, &g, nil)
-	if g.secretsMissing() {
-		g.fromEnvVar()
-		if g.secretsMissing() {
-			bot.Log.Fatal("GitHub plugin missing required secrets. Either " +
-				"fill out the configuration file or set the environment " +
-				"variables.")
-		}
+func newGitHub(bot *lib.Bot, _ string, cfg lib.PluginConfig) (lib.Plugin, error) {
+	g := ghPlugin{issues: make(map[string]*filedIssue)}
+	err := bot.DecodeConfig(cfg, &g, nil)
+	if err != nil {
+		return nil, err
 	}
 	g.client = g.createClient()
-	bot.OnCommand("issue", g.Issue)
-	return &g
+	bot.OnCommand("issue", g.Issue, lib.HandleEditsInPlace())
+	return &g, nil
 }
 
 /*
@@ -90,14 +80,58 @@ func (p *ghPlugin) Help() string {
 		"GitHub issue\n"
 }
 
+/*
+How many issues the plugin remembers the messages of. Editing an older message
+files a new issue, rather than editing the old one.
+*/
+const maxFiledIssues = 500
+
+/*
+An issue filed by the issue command, so that when the message is edited, the
+issue can be edited to match.
+*/
+type filedIssue struct {
+	lock        sync.Mutex // held while the issue is being filed or edited
+	owner, repo string
+	number      int    // zero until the issue has been filed
+	url         string // the issue's web page
+}
+
+/*
+Return the issue filed for a message, creating an empty one if there is none.
+*/
+func (p *ghPlugin) issueFor(evt *slack.MessageEvent) *filedIssue {
+	key := evt.Msg.Channel + "/" + evt.Msg.Timestamp
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if issue, ok := p.issues[key]; ok {
+		return issue
+	}
+	issue := &filedIssue{}
+	p.issues[key] = issue
+	p.issueOrder = append(p.issueOrder, key)
+	if len(p.issueOrder) > maxFiledIssues {
+		delete(p.issues, p.issueOrder[0])
+		p.issueOrder = p.issueOrder[1:]
+	}
+	return issue
+}
+
 /*
 This plugin asynchronously creates a GitHub issue. The command looks like this:
 
     slacksoc issue [me] owner/repo "title" ["body" [assignee]]
+
+If the message is edited after the issue was created, the issue is edited to
+match, instead of creating another one. If the command failed, it just runs
+again.
 */
 func (p *ghPlugin) Issue(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
 	// goroutine is asynchronous so that we don't block the main thread
 	go func() {
+		ctx, cancel := bot.CommandContext(args[0])
+		defer cancel()
+
 		// standardize the args to start at 0
 		if len(args) >= 2 && args[1] == "me" {
 			args = args[2:]
@@ -136,7 +170,6 @@ func (p *ghPlugin) Issue(bot *lib.Bot, evt *slack.MessageEvent, args []string) e
 		if len(args) >= 4 {
 			assignee = &args[3]
 		}
-		issueState := "open"
 
 		// and send the request
 		request := github.IssueRequest{
@@ -144,23 +177,65 @@ func (p *ghPlugin) Issue(bot *lib.Bot, evt *slack.MessageEvent, args []string) e
 			Body:      &body,
 			Labels:    nil,
 			Assignee:  assignee,
-			State:     &issueState,
 			Milestone: nil,
 		}
-		issue, _, err := p.client.Issues.Create(context.TODO(), owner, repo, &request)
 		logEntry := bot.Log.WithFields(logrus.Fields{
 			"title": title, "body": body, "owner": owner, "repos": repo,
 		})
 		if assignee != nil {
 			logEntry.Data["assignee"] = *assignee
 		}
-		if err != nil {
-			bot.Reply(evt, "Error creating the issue: "+err.Error())
-			logEntry.Error("Error creating a GitHub issue.")
+		filed := p.issueFor(evt)
+		filed.lock.Lock()
+		defer filed.lock.Unlock()
+		if filed.number != 0 {
+			p.editIssue(ctx, bot, evt, filed, owner, repo, &request, logEntry)
 		} else {
-			bot.Reply(evt, *issue.HTMLURL)
-			logEntry.Info("Created a GitHub issue.")
+			p.createIssue(ctx, bot, evt, filed, owner, repo, &request, logEntry)
 		}
 	}()
 	return nil
 }
+
+/*
+File a new issue, and reply with its URL. Assumes that we hold the issue's lock.
+*/
+func (p *ghPlugin) createIssue(ctx context.Context, bot *lib.Bot,
+	evt *slack.MessageEvent, filed *filedIssue, owner, repo string,
+	request *github.IssueRequest, logEntry *logrus.Entry) {
+	issueState := "open"
+	request.State = &issueState
+	issue, _, err := p.client.Issues.Create(ctx, owner, repo, request)
+	if err != nil {
+		bot.Reply(evt, format.Sprintf("Error creating the issue: %s", err).String())
+		logEntry.Error("Error creating a GitHub issue.")
+		return
+	}
+	logEntry.Info("Created a GitHub issue.")
+	filed.owner, filed.repo = owner, repo
+	filed.number, filed.url = *issue.Number, *issue.HTMLURL
+	bot.Reply(evt, filed.url)
+}
+
+/*
+Edit the issue which was filed for a message before it was edited, and update
+the reply with its URL. Assumes that we hold the issue's lock.
+*/
+func (p *ghPlugin) editIssue(ctx context.Context, bot *lib.Bot,
+	evt *slack.MessageEvent, filed *filedIssue, owner, repo string,
+	request *github.IssueRequest, logEntry *logrus.Entry) {
+	if owner != filed.owner || repo != filed.repo {
+		bot.Reply(evt, format.Sprintf("error: issue %s is in %s/%s, and it "+
+			"can't be moved", filed.url, filed.owner, filed.repo).String())
+		return
+	}
+	logEntry.Data["number"] = filed.number
+	_, _, err := p.client.Issues.Edit(ctx, owner, repo, filed.number, request)
+	if err != nil {
+		bot.Reply(evt, format.Sprintf("Error updating the issue: %s", err).String())
+		logEntry.Error("Error updating a GitHub issue.")
+		return
+	}
+	logEntry.Info("Updated a GitHub issue.")
+	bot.Reply(evt, filed.url+" (updated)") // in place of the old reply
+}
@@ -1,19 +1,27 @@
 package plugins
 
-import "fmt"
-import "os"
+import "context"
 import "strings"
 
 import "github.com/brenns10/slacksoc/lib"
+import "github.com/brenns10/slacksoc/lib/format"
 import "github.com/hacsoc/golove/love"
 import "github.com/nlopes/slack"
 import "github.com/sirupsen/logrus"
 
+type loveConfig struct {
+	ApiKey  string `required:"true" example:"\"${LOVE_API_KEY}\"" desc:"You'll need to get this from the Admin section of CWRU love."`
+	BaseUrl string `required:"true" example:"https://cwrulove.appspot.com/api" desc:"The URL of the \"api\" endpoint, without the trailing slash."`
+}
+
 type lov struct {
 	client love.Client
 }
 
 func usernameForUser(user *slack.User) string {
+	if user == nil {
+		return ""
+	}
 	email := user.Profile.Email
 	if email == "" {
 		return email
@@ -22,18 +30,44 @@ func usernameForUser(user *slack.User) string {
 }
 
 func usernameForString(bot *lib.Bot, arg string) string {
-	uid := lib.ParseUserMention(arg)
-	if uid != "" {
-		return usernameForUser(bot.GetUserByID(uid))
+	if strings.HasPrefix(arg, "<@") {
+		user, err := bot.ResolveUser(arg)
+		if err != nil {
+			return ""
+		}
+		return usernameForUser(user)
+	} else if i := strings.Index(arg, "@"); i > 0 {
+		// an email address, whose Case ID is the part before the @
+		return arg[:i]
 	} else {
 		return arg
 	}
 }
 
+/*
+Send loves, giving up when ctx is done. The love client doesn't take a context,
+so if it hangs, its goroutine is left to finish on its own.
+*/
+func (l *lov) sendLoves(ctx context.Context, sender string, recipients []string,
+	message string) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- l.client.SendLoves(sender, recipients, message)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (l *lov) Love(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
 	// the whole thing is done asynchronously due to the API call, so we do not
 	// block the main slacksoc goroutine
 	go func() {
+		ctx, cancel := bot.CommandContext(args[0])
+		defer cancel()
 		if len(args) <= 2 {
 			bot.Reply(evt, l.Help())
 			return
@@ -43,8 +77,8 @@ func (l *lov) Love(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
 			username := usernameForString(bot, arg)
 			// deal with possible error getting a username
 			if username == "" {
-				bot.Reply(evt, fmt.Sprintf("Sorry, we had trouble turning "+
-					"\"%s\" into a Case ID.", arg))
+				bot.Reply(evt, format.Sprintf("Sorry, we had trouble turning "+
+					"\"%s\" into a Case ID.", arg).String())
 				return
 			}
 			usernames = append(usernames, usernameForString(bot, arg))
@@ -60,12 +94,15 @@ func (l *lov) Love(bot *lib.Bot, evt *slack.MessageEvent, args []string) error {
 			"usernames": usernames, "sender": sender,
 			"message": args[len(args)-1],
 		})
-		err := l.client.SendLoves(sender, usernames, args[len(args)-1])
+		err := l.sendLoves(ctx, sender, usernames, args[len(args)-1])
 		if err != nil {
 			entry.Error(err)
-			if strings.HasPrefix(err.Error(), "Love API Error: ") {
-				// API errors are safe and contain user info
-				bot.Reply(evt, err.Error())
+			if err == context.DeadlineExceeded || err == context.Canceled {
+				bot.Reply(evt, "Sorry, the love API didn't respond in time.")
+			} else if strings.HasPrefix(err.Error(), "Love API Error: ") {
+				// API errors are safe and contain user info, but they may echo
+				// the message, so escape them
+				bot.Reply(evt, format.Escape(err.Error()).String())
 			} else {
 				// HTTP/other errors may contain sensitive info
 				bot.Reply(evt, "An error occurred sending love. Consult slacksoc's"+
@@ -93,15 +130,15 @@ func (l *lov) Help() string {
 		" bash shell commands."
 }
 
-func newLove(bot *lib.Bot, _ string, cfg lib.PluginConfig) lib.Plugin {
+func newLove(bot *lib.Bot, _ string, cfg lib.PluginConfig) (lib.Plugin, error) {
 	d := &lov{}
-	bot.Configure(cfg, &d.client, []string{"BaseUrl"})
-	if d.client.ApiKey == "" {
-		d.client.ApiKey = os.Getenv("LOVE_API_KEY")
-		if d.client.ApiKey == "" {
-			bot.Log.Fatal("Love client missing API key.")
-		}
+	var config loveConfig
+	err := bot.DecodeConfig(cfg, &config, nil)
+	if err != nil {
+		return nil, err
 	}
+	d.client.ApiKey = config.ApiKey
+	d.client.BaseUrl = config.BaseUrl
 	bot.OnCommand("love", d.Love)
-	return d
+	return d, nil
 }
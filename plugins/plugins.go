@@ -3,39 +3,15 @@ This library contains a set of core plugins for the slacksoc bot. To register
 these plugins, simply use the provided Register() function. Below is a list of
 provided plugins (none of their implementations are publicly accessible).
 
+Each plugin's configuration is documented on its config struct, so the samples
+aren't repeated here. Run "slacksoc config sample" to get a complete, commented
+sample configuration for every plugin (this is also what sample.yaml contains).
+
 Respond Plugin
 
 Respond is a plugin which allows you to register triggers and one or more
 responses to those triggers. In functionality, it is pretty much a superset of
-Slackbot, since it allows regular expressions and reactions. Here is its sample
-configuration:
-
-  - name: Respond
-    # This is a list of objects that define a response. (As of now) only one
-    # response can ever fire at a time--the first match.
-    #
-    # * trigger is a regular expression that uses the syntax of RE2:
-    #   https://golang.org/s/re2syntax
-    #   + For case insensitive matching, put (?i) at the front of your regex
-    #   + The regular expression need only match within the string, not
-    #     necessarily the whole string.
-    #   + Use ^ and $ to match beginning/end of the string
-    #   + If you have trouble with YAML messing up your regex, check this:
-    #     http://stackoverflow.com/questions/6915756/uninterpreted-strings-in-yaml
-    #
-    # * replies - A list. One is randomly selected and sent to the channel on
-    #   match.
-    #
-    # * reacts - A list. One is randomly selected and added to the message on
-    #   match. Don't include colons. This will happen in addition to the reply.
-    responses:
-      - trigger: ^(yo|hey|hi|hello|sup),? slacksoc$
-        replies: ["hello", "wassup", "yo"]
-      - trigger: ^((good)?bye|adios),? slacksoc$
-        replies: ["goodbye"]
-      - trigger: (?i)i love you
-        reacts: ["heart"]
-
+Slackbot, since it allows regular expressions and reactions.
 
 Debug Plugin
 
@@ -44,10 +20,6 @@ the bot and testing some capabilities. Use `slacksoc help Debug` for more
 information on its "functionality". The only required configuration is a list of
 usernames that should be trusted to use the debug commands.
 
-  - name: Debug
-    trusted:
-      - brenns10
-
 Love Plugin
 
 Love is a CWRU Love client. It allows users to send each other love through a
@@ -58,46 +30,15 @@ See golove/love package docs for details:
 https://godoc.org/github.com/hacsoc/golove/love. See also the Yelp love repo
 for even more details: https://github.com/Yelp/love
 
-The ApiKey may be provided through the LOVE_API_KEY environment variable
-instead.
-
-Sample configuration:
-
-  - name: Love
-    # You'll need to get this from the Admin section of CWRU love. You can
-    # provide this token via the config file, or the LOVE_API_KEY environment
-    # variable.
-    apiKey: LOVE_API_KEY
-    baseUrl: https://cwrulove.appspot.com/api
+Like any other config value, the apiKey may be taken from an environment
+variable with ${LOVE_API_KEY} (see lib.Run for details).
 
 GitHub Plugin
 
 GitHub is a plugin which allows you to post a GitHub issue. See "slacksoc help
 GitHub" for usage instructions. In its config object, you will need to set the
-fields clientID, clientSecret, and accessToken. Or, you can specify them via
-environment variables.
-
-  - name: GitHub
-    # clientID and clientSecret should be created by registering an app
-    # https://github.com/settings/applications/new
-    clientID: GITHUB_CLIENT_ID
-    clientSecret: GITHUB_CLIENT_SECRET
-    # accessToken is the authorization for your application to act on behalf
-    # of a particular user. Log into this user on GitHub and go here:
-    #
-    # https://github.com/login/oauth/authorize?scope=repo&client_id=$CLIENT_ID
-    #
-    # Then, take the code appended to the URL and put it into this curl:
-    #
-    # curl -X POST -F 'client_id=$CLIENT_ID' \
-    #              -F 'client_secret=$CLIENT_SECRET' \
-    #              -F 'code=$CODE' \
-    #      https://github.com/login/oauth/access_token
-    #
-    # The accessToken will be in the response.
-    accessToken: GITHUB_ACCESS_TOKEN
-    # You may provide the above GitHub tokens via the correspondingly named
-    # environment variables instead (e.g. GITHUB_ACCESS_TOKEN)
+fields clientID, clientSecret, and accessToken. These are secrets, so you may
+want to substitute them from environment variables or files.
 
 RealName Plugin
 
@@ -108,9 +49,6 @@ you'll want to run this on the #general channel so that having real names set is
 a policy for the whole team. However, you could run it on another channel, and
 it will still work.
 
-  - name: RealName
-    channel: general
-
 HotPotato Plugin
 
 HotPotato is somewhat similar in spirit to Facebook Pokes, but as a fun little
@@ -120,35 +58,16 @@ to another user. If they don't pass it within a certain timeout, they will lose,
 and a new game may be started. There is only one potato per Slack team.
 
 The game encourages inclusion by artificially limiting the number of times the
-potato can be passed among a small group of players. See the config fragment
-for an explanation of the mechanism.
-
-  - name: HotPotato
-    # The timeout specifies how many MINUTES until a person loses the game for
-    # not passing the potato
-    timeout: 180
-    # The diversity threshold is an upper limit on the following quantity:
-    #
-    # diversity = (# of "possessions") / (# unique people)
-    #
-    # Say that the potato went A -> B -> C -> B -> D -> A -> E. There are a
-    # total of 7 "possessions" of the potato, and 5 unique people. So the
-    # diversity is 7/5 = 1.4.
-    #
-    # The game will not allow a potato pass that would make the diversity
-    # strictly greater than the threshold. The effect of this is to force the
-    # game to be played among new people, rather than cycling through the same
-    # clique of people. Hopefully, this encourages the game to be inclusive and
-    # fun!
-    diversityThreshold: 2.5
+potato can be passed among a small group of players. See the diversityThreshold
+setting in the sample config for an explanation of the mechanism.
 
 Plugin Library Design
 
 This plugin library demonstrates what I believe to be the best way to publish
 plugins. Make the type name and constructor private. Collect all your plugins
 into a single package, and then expose only a single public function to Register
-them. Finally, document each plugin at the package level, with configuration
-samples.
+them. Finally, document each plugin at the package level, and document its
+configuration with struct tags, registered with lib.RegisterConfig().
 
 */
 package plugins
@@ -165,4 +84,14 @@ func Register() {
 	lib.Register("GitHub", newGitHub)
 	lib.Register("RealName", newRealName)
 	lib.Register("HotPotato", newHotPotato)
+
+	lib.RegisterConfig("Respond", respond{})
+	lib.RegisterConfig("Debug", debugConfig{})
+	lib.RegisterConfig("Love", loveConfig{})
+	lib.RegisterConfig("GitHub", ghPlugin{})
+	lib.RegisterConfig("RealName", realName{})
+	lib.RegisterConfig("HotPotato", hotPotato{})
+
+	lib.RegisterState("Debug", debugState{})
+	lib.RegisterState("HotPotato", potatoGame{})
 }
@@ -13,7 +13,9 @@ import (
 	"time"
 
 	"github.com/brenns10/slacksoc/lib"
+	"github.com/brenns10/slacksoc/lib/format"
 	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
 )
 
 type potatoEntry struct {
@@ -29,67 +31,40 @@ type potatoGame struct {
 
 type hotPotato struct {
 	// Configurable fields
-	Timeout            int64
-	DiversityThreshold float64
+	Timeout            int64   `required:"true" example:"180" desc:"The timeout specifies how many MINUTES until a person loses the game for not passing the potato."`
+	DiversityThreshold float64 `required:"true" example:"2.5" desc:"The diversity threshold is an upper limit on the following quantity:\n\ndiversity = (# of \"possessions\") / (# unique people)\n\nSay that the potato went A -> B -> C -> B -> D -> A -> E. There are a total of 7 \"possessions\" of the potato, and 5 unique people. So the diversity is 7/5 = 1.4.\n\nThe game will not allow a potato pass that would make the diversity strictly greater than the threshold. The effect of this is to force the game to be played among new people, rather than cycling through the same clique of people. Hopefully, this encourages the game to be inclusive and fun!"`
 
 	// Private (non-configuration) fields
 	name       string
 	lock       sync.Mutex
 	passRegexp *regexp.Regexp
 	game       potatoGame
-	timersSet  bool
-	timer      *time.Timer
+	resumed    bool
 }
 
-func newHotPotato(bot *lib.Bot, name string, cfg lib.PluginConfig) lib.Plugin {
+func newHotPotato(bot *lib.Bot, name string, cfg lib.PluginConfig) (lib.Plugin, error) {
 	p := hotPotato{}
 	p.name = name
-	p.timersSet = false
 
-	bot.Configure(cfg, &p, []string{"Timeout", "DiversityThreshold"})
+	bot.Configure(cfg, &p, nil)
 	bot.GetState(name, &p.game) // in case a game already existed
 	p.passRegexp = regexp.MustCompile(`(?i)pass the (?:hot )?potato to <@(U\w+)(\|\w+)?>`)
 
-	bot.OnAddressedMatchExpr(p.passRegexp, p.locked(p.Pass))
-	bot.OnAddressedMatch(`(?i)^give me the potato[!.]?$`, p.locked(p.Give))
+	// all bot events take the lock, since the game timer also uses the game,
+	// and potato commands aren't for other plugins (like Respond) to answer
+	locked := lib.Serialize(&p.lock)
+	bot.OnAddressedMatchExpr(p.passRegexp,
+		lib.Chain(p.Pass, lib.Exclusive(), locked))
+	bot.OnAddressedMatch(`(?i)^give me the potato[!.]?$`,
+		lib.Chain(p.Give, lib.Exclusive(), locked))
 	bot.OnAddressedMatch(`(?i)^who has the (?:hot )?potato[?.!]?$`,
-		p.locked(p.Who))
+		lib.Chain(p.Who, lib.Exclusive(), locked))
 	bot.OnAddressedMatch(`(?i)^potato history$`,
-		p.locked(p.Had))
-	bot.OnEvent("hello", p.Hello)
+		lib.Chain(p.Had, lib.Exclusive(), locked))
+	bot.OnTimer(name, p.GameOver)
+	bot.OnEvent("hello", p.Resume)
 
-	return &p
-}
-
-/*
-This function runs once we've connected to slack (for the first time) and there
-was a pre-existing game on startup. It lets us restore timers and send some
-apologies in case people tried to pass the potato while we were down.
-*/
-func (p *hotPotato) Hello(bot *lib.Bot, evt slack.RTMEvent) error {
-	p.lock.Lock()
-
-	if len(p.game.History) > 0 && !p.timersSet {
-		// The bot started up and there was a game running!
-		bot.Log.Info("HotPotato: preexisting game, resetting...")
-		lastIdx := len(p.game.History) - 1
-		entry := &p.game.History[lastIdx]
-		duration := time.Duration(p.Timeout) * time.Minute
-		endTime := entry.Received.Add(duration)
-		remainingTime := endTime.Sub(time.Now())
-		if remainingTime <= time.Duration(0) {
-			bot.DirectMessage(entry.Uid, "Sorry, it looks like I crashed in "+
-				"the middle of your game. The game has ended, but you can "+
-				"start a new one if you'd like.",
-			)
-		}
-		p.timer = time.AfterFunc(
-			remainingTime, p.GameOver(bot, entry.Uid))
-	}
-	p.timersSet = true
-
-	p.lock.Unlock()
-	return nil
+	return &p, nil
 }
 
 func (p *hotPotato) Describe() string {
@@ -113,19 +88,6 @@ func (p *hotPotato) Help() string {
 		"have the potato. They'll know who passed it to them"
 }
 
-/*
-Takes a MessageHandler and wraps it with a locking statement so that all bot
-events take the lock.
-*/
-func (p *hotPotato) locked(mh lib.MessageHandler) lib.MessageHandler {
-	return func(bot *lib.Bot, evt *slack.MessageEvent) error {
-		p.lock.Lock()
-		rv := mh(bot, evt)
-		p.lock.Unlock()
-		return rv
-	}
-}
-
 /*
 Returns true if the user is already in the history.
 */
@@ -139,33 +101,87 @@ func (p *hotPotato) userInHistory(uid string) bool {
 }
 
 /*
-Returns a callable function that will end the game for the given user. This
-should be used with the Go Timer functionality. This function is capable of
-detecting if the potato was already passed, and not ending the game in that
-case.
+The payload of the durable timer which ends the game. Passes is the length of
+the history when the timer was set, so that a stale timer can be detected.
 */
-func (p *hotPotato) GameOver(bot *lib.Bot, uid string) func() {
-	currentLen := len(p.game.History)
-	return func() {
-		p.lock.Lock()
-		if len(p.game.History) != currentLen {
-			// Someone else got the potato, but somehow the timer wasn't
-			// canceled in time. Let's do the right thing: unlock and not send
-			// any messages.
-			p.lock.Unlock()
-			return
-		}
-		bot.DirectMessage(uid, "Uh oh, you ran out of time. Game Over!")
-		message := fmt.Sprintf("The game of hot potato ended with %s after "+
-			"%d passes.", bot.Mention(bot.GetUserByID(uid)), currentLen)
-		bot.Send(bot.GetChannelByName("random"), message)
-		p.game.History = nil
-		p.game.Unique = 0
-		bot.UpdateState(p.name, &p.game)
-		p.lock.Unlock()
+type potatoTimer struct {
+	Uid    string
+	Passes int
+}
+
+const potatoTimerID = "gameover"
+
+/*
+Start (or restart) the timer for whoever has the potato now. The timer is saved
+in the bot state, so it survives restarts. Assumes that we hold the lock.
+*/
+func (p *hotPotato) startTimer(bot *lib.Bot) {
+	entry := p.game.History[len(p.game.History)-1]
+	deadline := entry.Received.Add(time.Duration(p.Timeout) * time.Minute)
+	err := bot.Schedule(p.name, potatoTimerID, deadline, potatoTimer{
+		Uid:    entry.Uid,
+		Passes: len(p.game.History),
+	})
+	if err != nil {
+		bot.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("HotPotato: could not schedule timer.")
 	}
 }
 
+/*
+Handles connecting to Slack. If a game was running when we stopped, its timer
+should be saved too, but state from older versions didn't have one, so we set it
+again. This waits until we connect, so that validating the config (or skipping
+this plugin) doesn't schedule anything.
+*/
+func (p *hotPotato) Resume(bot *lib.Bot, evt slack.RTMEvent) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.resumed {
+		return nil // just a reconnect
+	}
+	p.resumed = true
+	if len(p.game.History) > 0 {
+		p.startTimer(bot)
+	}
+	return nil
+}
+
+/*
+Handles the timer running out, which ends the game for the person holding the
+potato. If the timer ran out while the bot was down, we send them an apology as
+well, in case they tried to pass the potato in the meantime.
+*/
+func (p *hotPotato) GameOver(bot *lib.Bot, timer *lib.DurableTimer) error {
+	var t potatoTimer
+	err := timer.Payload(&t)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.game.History) != t.Passes {
+		// Someone else got the potato, but somehow the timer wasn't replaced
+		// in time. Let's do the right thing and not send any messages.
+		return nil
+	}
+	if timer.Late {
+		bot.DirectMessage(t.Uid, "Sorry, it looks like I crashed in "+
+			"the middle of your game. The game has ended, but you can "+
+			"start a new one if you'd like.",
+		)
+	}
+	bot.DirectMessage(t.Uid, "Uh oh, you ran out of time. Game Over!")
+	message := fmt.Sprintf("The game of hot potato ended with %s after "+
+		"%d passes.", bot.Mention(bot.GetUserByID(t.Uid)), t.Passes)
+	bot.Send(bot.GetChannelByName("random"), message)
+	p.game.History = nil
+	p.game.Unique = 0
+	bot.UpdateState(p.name, &p.game)
+	return nil
+}
+
 /*
 Handles the "pass the potato" command. Assumes that we hold the lock.
 */
@@ -199,18 +215,16 @@ func (p *hotPotato) Pass(bot *lib.Bot, evt *slack.MessageEvent) error {
 	}
 
 	// add a history entry for this pass
-	p.game.History[lastIdx].Passed = time.Now()
+	p.game.History[lastIdx].Passed = bot.Now()
 	newEntry := potatoEntry{
 		Uid:      target,
-		Received: time.Now(),
+		Received: bot.Now(),
 	}
 	p.game.History = append(p.game.History, newEntry)
 	bot.UpdateState(p.name, &p.game)
 
-	// stop the old timer and start a new one
-	p.timer.Stop()
-	p.timer = time.AfterFunc(time.Duration(p.Timeout)*time.Minute,
-		p.GameOver(bot, target))
+	// replace the old timer with a new one
+	p.startTimer(bot)
 
 	// notify the new person that they have the potato
 	bot.DirectMessage(target, fmt.Sprintf(
@@ -249,15 +263,14 @@ func (p *hotPotato) Give(bot *lib.Bot, evt *slack.MessageEvent) error {
 	// Add new entry to history
 	newEntry := potatoEntry{
 		Uid:      evt.User,
-		Received: time.Now(),
+		Received: bot.Now(),
 	}
 	p.game.History = append(p.game.History, newEntry)
 	p.game.Unique = 1
 	bot.UpdateState(p.name, &p.game)
 
 	// Set a new timer.
-	p.timer = time.AfterFunc(time.Duration(p.Timeout)*time.Minute,
-		p.GameOver(bot, evt.User))
+	p.startTimer(bot)
 
 	// And send messages to people.
 	bot.Reply(evt,
@@ -280,14 +293,15 @@ func (p *hotPotato) Who(bot *lib.Bot, evt *slack.MessageEvent) error {
 
 	lastIdx := len(p.game.History) - 1
 	lastEntry := p.game.History[lastIdx]
-	user := bot.GetUserByID(lastEntry.Uid)
 	deadline := lastEntry.Received.Add(time.Duration(p.Timeout) * time.Minute)
-	bot.Reply(evt, fmt.Sprintf(
+	bot.Reply(evt, format.Sprintf(
 		"%s got the hot potato at %s. They have until %s to pass it. "+
 			"The potato has been passed %d times.",
-		bot.Mention(user), lastEntry.Received.Format("3:04 PM"),
-		deadline.Format("3:04 PM"), len(p.game.History),
-	))
+		format.User(lastEntry.Uid),
+		format.Date(lastEntry.Received, format.Time, lastEntry.Received.Format("3:04 PM")),
+		format.Date(deadline, format.Time, deadline.Format("3:04 PM")),
+		len(p.game.History),
+	).String())
 
 	return nil
 }
@@ -304,7 +318,11 @@ func (p *hotPotato) Had(bot *lib.Bot, evt *slack.MessageEvent) error {
 	buffer.WriteString(bot.User.Name)
 	for _, entry := range p.game.History {
 		buffer.WriteString(" - ")
-		buffer.WriteString(bot.GetUserByID(entry.Uid).Name)
+		if user := bot.GetUserByID(entry.Uid); user != nil {
+			buffer.WriteString(user.Name)
+		} else {
+			buffer.WriteString(entry.Uid) // they have left the team
+		}
 	}
 	bot.Reply(evt, buffer.String())
 	return nil
@@ -6,7 +6,7 @@ import "github.com/brenns10/slacksoc/lib"
 import "github.com/nlopes/slack"
 
 type realName struct {
-	Channel string
+	Channel string `required:"true" example:"general" desc:"Name of the channel to watch for joins (without the #)."`
 }
 
 func (r *realName) RealName(bot *lib.Bot, event *slack.MessageEvent) error {
@@ -34,9 +34,9 @@ func (r *realName) Help() string {
 		"without setting their real name field."
 }
 
-func newRealName(bot *lib.Bot, _ string, cfg lib.PluginConfig) lib.Plugin {
+func newRealName(bot *lib.Bot, _ string, cfg lib.PluginConfig) (lib.Plugin, error) {
 	r := &realName{}
-	bot.Configure(cfg, &r, []string{"Channel"})
+	bot.Configure(cfg, r, nil)
 	bot.OnMessage("channel_join", r.RealName)
-	return r
+	return r, nil
 }
@@ -1,5 +1,6 @@
 package plugins
 
+import "fmt"
 import "math/rand"
 import "regexp"
 
@@ -11,10 +12,10 @@ import "github.com/sirupsen/logrus"
 An entry to associate a trigger with multiple potential replies.
 */
 type response struct {
-	Trigger string
+	Trigger string `required:"true" example:"^(yo|hey|hi|hello|sup),? slacksoc$" desc:"A regular expression that uses the syntax of RE2: https://golang.org/s/re2syntax\n+ For case insensitive matching, put (?i) at the front of your regex\n+ The regular expression need only match within the string, not necessarily the whole string.\n+ Use ^ and $ to match beginning/end of the string\n+ If you have trouble with YAML messing up your regex, check this: http://stackoverflow.com/questions/6915756/uninterpreted-strings-in-yaml"`
 	trigger *regexp.Regexp
-	Replies []string
-	Reacts  []string
+	Replies []string `example:"[\"hello\", \"wassup\", \"yo\"]" desc:"A list. One is randomly selected and sent to the channel on match."`
+	Reacts  []string `example:"[\"wave\"]" desc:"A list. One is randomly selected and added to the message on match. Don't include colons. This will happen in addition to the reply."`
 }
 
 /*
@@ -22,22 +23,32 @@ This is a fairly simple plugin that allows you to configure triggers and
 responses, nearly identical to traditional slackbot.
 */
 type respond struct {
-	Responses []response
+	Responses []response `required:"true" desc:"This is a list of objects that define a response. Only one response can ever fire at a time--the first match."`
 }
 
 /*
 Creates a new Respond plugin. Don't bother calling this yourself, or even
 manually registering it. Instead, use Register function for the core plugin lib.
 */
-func newRespond(bot *lib.Bot, name string, config lib.PluginConfig) lib.Plugin {
+func newRespond(bot *lib.Bot, name string, config lib.PluginConfig) (lib.Plugin, error) {
 	var respond respond
-	bot.Configure(config, &respond, []string{"Responses"})
+	bot.Configure(config, &respond, nil)
+	responses := respond.Responses[:0]
 	for i, resp := range respond.Responses {
-		respond.Responses[i].trigger = regexp.MustCompile(resp.Trigger)
-		respond.Responses[i].trigger.Longest() // leftmost longest match
+		trigger, err := regexp.Compile(resp.Trigger)
+		if err != nil {
+			bot.ConfigError(&lib.PluginConfigError{
+				Key: fmt.Sprintf("responses[%d].trigger", i), Err: err,
+			})
+			continue
+		}
+		trigger.Longest() // leftmost longest match
+		resp.trigger = trigger
+		responses = append(responses, resp)
 	}
+	respond.Responses = responses
 	bot.OnMessage("", respond.Respond)
-	return &respond
+	return &respond, nil
 }
 
 func (r *respond) Describe() string {